@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	minAggregateInterval = time.Minute
+	maxAggregateInterval = 31 * 24 * time.Hour
+)
+
+// aggregates - The InfluxQL functions a client may ask readings to be bucketed with
+var aggregates = map[string]bool{
+	"mean":  true,
+	"min":   true,
+	"max":   true,
+	"sum":   true,
+	"count": true,
+	"first": true,
+	"last":  true,
+}
+
+var intervalPattern = regexp.MustCompile(`^([0-9]+)([mhd])$`)
+
+// parseInterval parses an interval such as 5m, 1h or 1d
+func parseInterval(s string) (time.Duration, error) {
+	m := intervalPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, errors.New("interval must be a number followed by m, h or d")
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	unit := map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[m[2]]
+	d := time.Duration(n) * unit
+	if d < minAggregateInterval || d > maxAggregateInterval {
+		return 0, errors.New("interval out of range")
+	}
+	return d, nil
+}
+
+// parseAggregation reads the aggregate, interval and fill query parameters into q.
+// Without an explicit date range the window covers one page of buckets up to now.
+func parseAggregation(c *gin.Context, q *readingQuery, limit int) error {
+	aggregate, interval, fill := c.Query("aggregate"), c.Query("interval"), c.Query("fill")
+	if aggregate == "" {
+		if interval != "" || fill != "" {
+			return errors.New("interval and fill require aggregate")
+		}
+		return nil
+	}
+	if !aggregates[aggregate] {
+		return errors.New("unknown aggregate " + aggregate)
+	}
+	if q.Latest {
+		return errors.New("aggregate cannot be combined with latest")
+	}
+	if interval == "" {
+		interval = "1h"
+	}
+	d, err := parseInterval(interval)
+	if err != nil {
+		return err
+	}
+	if fill == "" {
+		fill = "none"
+	}
+	if !validFill(fill) {
+		return errors.New("fill must be none, previous, linear or a number")
+	}
+
+	q.Aggregate, q.Interval, q.Fill = aggregate, d, fill
+	if q.StartDate.IsZero() {
+		q.EndDate = time.Now()
+		q.StartDate = q.EndDate.Add(-time.Duration(limit) * d)
+	}
+	return nil
+}
+
+// aggregateBucket - The raw values falling into one GROUP BY time() interval
+type aggregateBucket struct {
+	start  time.Time
+	values []float64
+}
+
+// aggregateReadings buckets readings the way InfluxDB's GROUP BY time() does.
+// readings must be oldest first and already restricted to q's time range; the
+// buckets are returned newest first.
+func aggregateReadings(sensorID string, readings []reading, q readingQuery) []reading {
+	var buckets []aggregateBucket
+	first := q.StartDate.Truncate(q.Interval)
+	for start := first; !start.After(q.EndDate); start = start.Add(q.Interval) {
+		buckets = append(buckets, aggregateBucket{start: start})
+	}
+	for _, r := range readings {
+		i := int(readingTime(r).Sub(first) / q.Interval)
+		if i >= 0 && i < len(buckets) {
+			buckets[i].values = append(buckets[i].values, r.Value)
+		}
+	}
+
+	var out []reading
+	for i, b := range buckets {
+		k := reading{Sensor: sensorID, DateTime: b.start.UTC().Format("2006-01-02T15:04:05.999Z07:00")}
+		if len(b.values) > 0 {
+			k.Value = aggregateValues(q.Aggregate, b.values)
+		} else if v, ok := fillValue(q, buckets, i, out); ok {
+			k.Value = v
+		} else {
+			continue
+		}
+		out = append(out, k)
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func aggregateValues(fn string, values []float64) float64 {
+	switch fn {
+	case "min", "max":
+		v := values[0]
+		for _, x := range values[1:] {
+			if (fn == "min" && x < v) || (fn == "max" && x > v) {
+				v = x
+			}
+		}
+		return v
+	case "count":
+		return float64(len(values))
+	case "first":
+		return values[0]
+	case "last":
+		return values[len(values)-1]
+	}
+	sum := 0.0
+	for _, x := range values {
+		sum += x
+	}
+	if fn == "sum" {
+		return sum
+	}
+	return sum / float64(len(values))
+}
+
+// fillValue computes the value of the empty bucket i from the buckets emitted so far
+func fillValue(q readingQuery, buckets []aggregateBucket, i int, emitted []reading) (float64, bool) {
+	switch q.Fill {
+	case "none":
+		return 0, false
+	case "previous":
+		if len(emitted) == 0 {
+			return 0, false
+		}
+		return emitted[len(emitted)-1].Value, true
+	case "linear":
+		if len(emitted) == 0 {
+			return 0, false
+		}
+		prev := emitted[len(emitted)-1]
+		for j := i + 1; j < len(buckets); j++ {
+			if len(buckets[j].values) > 0 {
+				// Interpolate between the previous bucket and the next populated one
+				nextValue := aggregateValues(q.Aggregate, buckets[j].values)
+				span := buckets[j].start.Sub(readingTime(prev)).Seconds()
+				offset := buckets[i].start.Sub(readingTime(prev)).Seconds()
+				return prev.Value + (nextValue-prev.Value)*offset/span, true
+			}
+		}
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(q.Fill, 64)
+	return v, err == nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAggregation(t *testing.T) {
+	start := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 3, 1, 13, 59, 0, 0, time.UTC)
+	readings := []reading{
+		{Sensor: "s1", DateTime: "2018-03-01T10:00:00Z", Value: 1},
+		{Sensor: "s1", DateTime: "2018-03-01T10:30:00Z", Value: 3},
+		{Sensor: "s1", DateTime: "2018-03-01T13:15:00Z", Value: 8},
+	}
+
+	Convey("Subject: Server-side aggregation of readings", t, func() {
+
+		Convey("When an hourly mean is built as InfluxQL", func() {
+			q := sensorReadingsQuery("s1", readingQuery{StartDate: start, EndDate: end, Aggregate: "mean", Interval: time.Hour, Fill: "none", Limit: 10})
+			So(q, ShouldEqual, `SELECT mean("value") AS "value" FROM /.*/ WHERE "sensor_id" = 's1' AND time >= '2018-03-01T10:00:00Z' AND time <= '2018-03-01T13:59:00Z' GROUP BY time(1h) fill(none) ORDER BY time DESC LIMIT 10`)
+		})
+
+		Convey("When the next page of hourly means is built as InfluxQL", func() {
+			before := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+			q := sensorReadingsQuery("s1", readingQuery{StartDate: start, EndDate: end, Before: before, Aggregate: "mean", Interval: time.Hour, Fill: "none", Limit: 10})
+			Convey("Then the page's first bucket keeps every reading in its hour", func() {
+				So(q, ShouldEqual, `SELECT mean("value") AS "value" FROM /.*/ WHERE "sensor_id" = 's1' AND time >= '2018-03-01T10:00:00Z' AND time <= '2018-03-01T13:59:00Z' AND time < '2018-03-01T13:00:00Z' GROUP BY time(1h) fill(none) ORDER BY time DESC LIMIT 10`)
+			})
+		})
+
+		Convey("When readings are bucketed in memory with fill(none)", func() {
+			out := aggregateReadings("s1", readings, readingQuery{StartDate: start, EndDate: end, Aggregate: "mean", Interval: time.Hour, Fill: "none"})
+			Convey("Then only populated buckets are returned newest first", func() {
+				So(len(out), ShouldEqual, 2)
+				So(out[0].DateTime, ShouldEqual, "2018-03-01T13:00:00Z")
+				So(out[0].Value, ShouldEqual, 8)
+				So(out[1].DateTime, ShouldEqual, "2018-03-01T10:00:00Z")
+				So(out[1].Value, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When empty buckets are filled", func() {
+			previous := aggregateReadings("s1", readings, readingQuery{StartDate: start, EndDate: end, Aggregate: "max", Interval: time.Hour, Fill: "previous"})
+			linear := aggregateReadings("s1", readings, readingQuery{StartDate: start, EndDate: end, Aggregate: "max", Interval: time.Hour, Fill: "linear"})
+			zero := aggregateReadings("s1", readings, readingQuery{StartDate: start, EndDate: end, Aggregate: "count", Interval: time.Hour, Fill: "0"})
+			So(len(previous), ShouldEqual, 4)
+			So(previous[1].Value, ShouldEqual, 3)
+			So(linear[2].Value, ShouldAlmostEqual, 3+5.0/3, 1e-9)
+			So(linear[1].Value, ShouldAlmostEqual, 3+10.0/3, 1e-9)
+			So(zero[3].Value, ShouldEqual, 2)
+			So(zero[2].Value, ShouldEqual, 0)
+		})
+
+		Convey("When a sensor's readings are requested with aggregate=sum", func() {
+			config, _ := newMemoryTestConfig()
+			router := setupRouter(config)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/sensors/device:testsen1:sensorid:1/readings?aggregate=sum&interval=1d&startDate=2018-03-01T00:00:00Z&endDate=2018-03-01T23:59:59Z", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then a single daily bucket is returned", func() {
+				So(w.Code, ShouldEqual, 200)
+				var body struct {
+					Items []reading `json:"items"`
+				}
+				So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+				So(len(body.Items), ShouldEqual, 1)
+				So(body.Items[0].DateTime, ShouldEqual, "2018-03-01T00:00:00Z")
+				So(body.Items[0].Value, ShouldEqual, 2.5)
+			})
+		})
+
+		Convey("When the aggregation parameters are invalid", func() {
+			config, _ := newMemoryTestConfig()
+			router := setupRouter(config)
+			for _, params := range []string{"aggregate=median", "aggregate=mean&interval=5s", "aggregate=mean&fill=null)", "interval=1h", "aggregate=mean&latest=true"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/sensors/device:testsen1:sensorid:1/readings?"+params, nil)
+				router.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 400)
+			}
+		})
+	})
+}
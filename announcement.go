@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Announcement documents are stored as "announcement:<uuid>"
+const announcementIDPrefix = "announcement:"
+
+// isAnnouncementID reports whether a document ID names an announcement, so
+// other documents cannot be changed through the announcement endpoints
+func isAnnouncementID(id string) bool {
+	return strings.HasPrefix(id, announcementIDPrefix)
+}
+
+// announcementError - An announcement that is missing text or names an unknown service
+type announcementError struct {
+	msg string
+}
+
+func (e announcementError) Error() string {
+	return e.msg
+}
+
+// announcementPatch - The editable fields of an announcement, nil fields are left unchanged
+type announcementPatch struct {
+	Title   *string    `json:"title"`
+	Message *string    `json:"message"`
+	Service *string    `json:"service"`
+	Expires *time.Time `json:"expires"`
+}
+
+// apply copies the fields set in the patch onto an announcement
+func (p announcementPatch) apply(m *serviceMessage) {
+	if p.Title != nil {
+		m.Title = *p.Title
+	}
+	if p.Message != nil {
+		m.Message = *p.Message
+	}
+	if p.Service != nil {
+		m.Service = *p.Service
+	}
+	if p.Expires != nil {
+		m.Expires = p.Expires
+	}
+}
+
+// active reports whether an announcement has not yet expired
+func (m serviceMessage) active(now time.Time) bool {
+	return m.Expires == nil || m.Expires.After(now)
+}
+
+// validAnnouncement checks an announcement has text and is either global or
+// attached to a service reported by GET /status
+func validAnnouncement(m serviceMessage) error {
+	if strings.TrimSpace(m.Title) == "" || strings.TrimSpace(m.Message) == "" {
+		return announcementError{"title and message are required"}
+	}
+	if m.Service == "" {
+		return nil
+	}
+	for _, s := range healthServices {
+		if s == m.Service {
+			return nil
+		}
+	}
+	return announcementError{fmt.Sprintf("unknown service %q, expected one of %s or none for the whole API", m.Service, strings.Join(healthServices, ", "))}
+}
+
+// attachAnnouncements files the active announcements under the service they are
+// about, returning those about the whole API
+func attachAnnouncements(messages []serviceMessage, services []serviceStatus, now time.Time) []serviceMessage {
+	global := []serviceMessage{}
+	for _, m := range messages {
+		if !m.active(now) {
+			continue
+		}
+		if m.Service == "" {
+			global = append(global, m)
+			continue
+		}
+		for i := range services {
+			if services[i].Service == m.Service {
+				services[i].Messages = append(services[i].Messages, m)
+			}
+		}
+	}
+	return global
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAnnouncements(t *testing.T) {
+
+	config, _ := newMemoryTestConfig()
+	config.devices = newFakeTTN()
+	router := setupRouter(config)
+
+	request := func(method, path string, body interface{}) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		router.ServeHTTP(w, req)
+		var got map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return w.Code, got
+	}
+
+	serviceMessages := func(status map[string]interface{}, service string) []interface{} {
+		for _, s := range status["services"].([]interface{}) {
+			if s.(map[string]interface{})["service"] == service {
+				return s.(map[string]interface{})["messages"].([]interface{})
+			}
+		}
+		return nil
+	}
+
+	Convey("Subject: Operator service announcements", t, func() {
+
+		Convey("When an announcement has no message", func() {
+			code, _ := request("POST", "/announcements", map[string]interface{}{"title": "Maintenance"})
+			So(code, ShouldEqual, 400)
+		})
+
+		Convey("When an announcement names an unknown service", func() {
+			code, body := request("POST", "/announcements", map[string]interface{}{"title": "Maintenance", "message": "Upgrade", "service": "mqtt"})
+			So(code, ShouldEqual, 400)
+			So(body["error"].(map[string]interface{})["message"], ShouldContainSubstring, "unknown service")
+		})
+
+		Convey("When a global and a TTN announcement are made", func() {
+			code, global := request("POST", "/announcements", map[string]interface{}{"title": "Planned maintenance", "message": "The API is down on Sunday"})
+			So(code, ShouldEqual, 201)
+			code, ttn := request("POST", "/announcements", map[string]interface{}{"title": "TTN outage", "message": "Uplinks are delayed", "service": serviceTTN})
+			So(code, ShouldEqual, 201)
+			globalID := global["items"].(map[string]interface{})["@id"].(string)
+			ttnID := ttn["items"].(map[string]interface{})["@id"].(string)
+			So(globalID, ShouldStartWith, announcementIDPrefix)
+
+			Convey("Then GET /status shows each where it belongs", func() {
+				_, status := request("GET", "/status", nil)
+				So(status["messages"], ShouldHaveLength, 1)
+				So(status["messages"].([]interface{})[0].(map[string]interface{})["title"], ShouldEqual, "Planned maintenance")
+				So(serviceMessages(status, serviceTTN), ShouldHaveLength, 1)
+				So(serviceMessages(status, serviceMemory), ShouldBeEmpty)
+			})
+
+			Convey("Then an update changes the text", func() {
+				code, body := request("PATCH", "/announcements/"+ttnID, map[string]interface{}{"message": "Uplinks are back"})
+				So(code, ShouldEqual, 200)
+				So(body["items"].(map[string]interface{})["message"], ShouldEqual, "Uplinks are back")
+			})
+
+			Convey("Then an expired announcement leaves GET /status but is still listed", func() {
+				code, _ := request("DELETE", "/announcements/"+globalID, nil)
+				So(code, ShouldEqual, 200)
+				_, status := request("GET", "/status", nil)
+				So(status["messages"], ShouldBeEmpty)
+				So(serviceMessages(status, serviceTTN), ShouldHaveLength, 1)
+
+				_, list := request("GET", "/announcements", nil)
+				So(len(list["items"].([]interface{})), ShouldBeGreaterThanOrEqualTo, 2)
+			})
+
+			Convey("Then an announcement due to expire later is still shown", func() {
+				later := time.Now().Add(time.Hour)
+				request("PATCH", "/announcements/"+ttnID, map[string]interface{}{"expires": later})
+				_, status := request("GET", "/status", nil)
+				So(serviceMessages(status, serviceTTN), ShouldHaveLength, 1)
+			})
+
+			request("DELETE", "/announcements/"+globalID, nil)
+			request("DELETE", "/announcements/"+ttnID, nil)
+		})
+
+		Convey("When an unknown announcement is expired", func() {
+			code, _ := request("DELETE", "/announcements/announcement:missing", nil)
+			So(code, ShouldEqual, 404)
+		})
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyHeader   = "X-API-Key"
+	apiKeyPrefix   = "knk_"
+	apiKeyIDPrefix = "apikey:" // Every API key document ID starts with it
+
+	defaultAPIKeyRateLimit = 60   // requests per minute
+	maxAPIKeyRateLimit     = 6000 // requests per minute
+	// apiKeyTouchInterval limits how often lastUsed is written back to the store
+	apiKeyTouchInterval = time.Minute
+)
+
+// apiKeyScopes - The scopes an API key can be issued with and the group each grants
+var apiKeyScopes = map[string]string{
+	"read:readings":  groupRead,
+	"manage:devices": groupDeviceAdmin,
+}
+
+// apiKey - A key for machine clients. Only the SHA-256 of the key is stored,
+// as part of the document ID, so a stored key cannot be used to call the API.
+type apiKey struct {
+	ID        string   `json:"@id"` // "apikey:" followed by the hex SHA-256 of the key
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"` // Organisation of the caller that issued the key, the key sees what it sees
+	Scopes    []string `json:"scopes"`
+	RateLimit int      `json:"rateLimit"` // Requests per minute
+	Created   string   `json:"created"`
+	LastUsed  string   `json:"lastUsed,omitempty"`
+}
+
+// apiKeyID returns the document ID a key is stored under
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyIDPrefix + hex.EncodeToString(sum[:])
+}
+
+// isAPIKeyID reports whether a document ID names an API key, so other
+// documents cannot be read or removed through the API key endpoints
+func isAPIKeyID(id string) bool {
+	return strings.HasPrefix(id, apiKeyIDPrefix)
+}
+
+// visibleAPIKeys drops the keys issued by other organisations
+func visibleAPIKeys(v visibility, keys []apiKey) []apiKey {
+	if !v.Restricted {
+		return keys
+	}
+	visible := []apiKey{}
+	for _, k := range keys {
+		if k.Owner == v.Org {
+			visible = append(visible, k)
+		}
+	}
+	return visible
+}
+
+// manageableAPIKey returns a key if the caller may revoke it. Keys of other
+// organisations are reported as not found so their existence is not given away.
+func manageableAPIKey(ctx context.Context, store MetadataStore, v visibility, keyID string) (apiKey, error) {
+	if !isAPIKeyID(keyID) {
+		return apiKey{}, errNotFound
+	}
+	k, err := store.APIKey(ctx, keyID)
+	if err != nil {
+		return k, err
+	}
+	if v.Restricted && k.Owner != v.Org {
+		return apiKey{}, errNotFound
+	}
+	return k, nil
+}
+
+// newAPIKeySecret returns a random key to hand to the client
+func newAPIKeySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// validAPIKey checks the scopes are known and the rate limit is in range,
+// applying the default rate limit when none is given
+func validAPIKey(k *apiKey) error {
+	if len(k.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range k.Scopes {
+		if _, ok := apiKeyScopes[scope]; !ok {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if k.RateLimit == 0 {
+		k.RateLimit = defaultAPIKeyRateLimit
+	}
+	if k.RateLimit < 0 || k.RateLimit > maxAPIKeyRateLimit {
+		return fmt.Errorf("rateLimit must be between 1 and %d requests per minute", maxAPIKeyRateLimit)
+	}
+	return nil
+}
+
+// groups returns the groups granted by the key's scopes
+func (k apiKey) groups() []string {
+	groups := make([]string, 0, len(k.Scopes))
+	for _, scope := range k.Scopes {
+		if g, ok := apiKeyScopes[scope]; ok {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// rateWindow - Requests counted for a key in the current minute
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// apiKeyAuth - Authenticates X-API-Key headers against the store, enforcing
+// each key's rate limit and recording when it was last used
+type apiKeyAuth struct {
+	store MetadataStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]rateWindow
+	touched map[string]time.Time
+}
+
+func newAPIKeyAuth(store MetadataStore) *apiKeyAuth {
+	return &apiKeyAuth{
+		store:   store,
+		now:     time.Now,
+		windows: map[string]rateWindow{},
+		touched: map[string]time.Time{},
+	}
+}
+
+// allow counts a request against the key, returning how long to wait when the
+// key has used up its requests for the current minute
+func (a *apiKeyAuth) allow(k apiKey) (ok bool, retryAfter time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	w := a.windows[k.ID]
+	if now.Sub(w.start) >= time.Minute {
+		w = rateWindow{start: now}
+	}
+	if w.count >= k.RateLimit {
+		return false, w.start.Add(time.Minute).Sub(now)
+	}
+	w.count++
+	a.windows[k.ID] = w
+	return true, 0
+}
+
+// touch records the key was used, at most once per apiKeyTouchInterval
+func (a *apiKeyAuth) touch(ctx context.Context, k apiKey) {
+	now := a.now()
+	a.mu.Lock()
+	due := now.Sub(a.touched[k.ID]) >= apiKeyTouchInterval
+	if due {
+		a.touched[k.ID] = now
+	}
+	a.mu.Unlock()
+
+	if due {
+		if err := a.store.TouchAPIKey(ctx, k.ID, now); err != nil {
+			contextLog(ctx).WithError(err).With(logFields{"apiKey": k.ID}).Warn("unable to record API key use")
+		}
+	}
+}
+
+// Groups authenticates the request with its X-API-Key header, falling back to
+// Auth0Groups for bearer tokens, and only lets callers in validGroups through
+func (a *apiKeyAuth) Groups(validGroups ...string) gin.HandlerFunc {
+	tokens := Auth0Groups(validGroups...)
+
+	return gin.HandlerFunc(func(c *gin.Context) {
+		key := c.GetHeader(apiKeyHeader)
+		if key == "" {
+			tokens(c)
+			return
+		}
+
+		ctx := requestContext(c)
+		k, err := a.store.APIKey(ctx, apiKeyID(key))
+		if err == errNotFound {
+			authFailures.WithLabelValues(authInvalidAPIKey).Inc()
+			respondError(c, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+
+		if ok, retryAfter := a.allow(k); !ok {
+			authFailures.WithLabelValues(authRateLimited).Inc()
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			respondError(c, http.StatusTooManyRequests, "API key rate limit exceeded")
+			return
+		}
+		a.touch(ctx, k)
+
+		authorize(c, caller{Subject: k.ID, Org: k.Owner, Groups: k.groups(), APIKey: k.ID}, validGroups)
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAPIKeys(t *testing.T) {
+	signer := testSigner(t)
+	defer func() { validator, groupsClaim = nil, defaultGroupsClaim }()
+	admin := testToken(signer, "auth0|admin", map[string]interface{}{"groups": []string{groupDeviceAdmin}})
+	medway := testToken(signer, "auth0|medway", map[string]interface{}{"groups": []string{groupDeviceAdmin}, "org": "medway"})
+	operator := testToken(signer, "auth0|operator", map[string]interface{}{"groups": []string{groupAdmin}, "org": "operators"})
+
+	Convey("Subject: API keys for machine clients", t, func() {
+		config, store := newMemoryTestConfig()
+		config.Auth0.Key = "test"
+		router := setupRouter(config)
+
+		request := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			for i := 0; i+1 < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			router.ServeHTTP(w, req)
+			return w
+		}
+		issue := func(body string) (string, apiKey) {
+			w := request("POST", "/apikeys", body, "Authorization", "Bearer "+admin)
+			So(w.Code, ShouldEqual, 201)
+			var resp struct {
+				Key   string `json:"key"`
+				Items apiKey `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return resp.Key, resp.Items
+		}
+
+		Convey("When an admin issues a read key", func() {
+			key, issued := issue(`{"name":"river logger","scopes":["read:readings"],"rateLimit":2}`)
+
+			Convey("Then only its hash is stored", func() {
+				So(key, ShouldStartWith, apiKeyPrefix)
+				stored, err := store.APIKey(context.Background(), issued.ID)
+				So(err, ShouldBeNil)
+				So(stored.ID, ShouldEqual, apiKeyID(key))
+				So(stored.ID, ShouldNotContainSubstring, key)
+				So(stored.Owner, ShouldEqual, "auth0|admin")
+			})
+
+			Convey("Then it can read but not manage devices", func() {
+				So(request("GET", "/devices", "", apiKeyHeader, key).Code, ShouldEqual, 200)
+				So(request("DELETE", "/devices/device:testsen1", "", apiKeyHeader, key).Code, ShouldEqual, 403)
+			})
+
+			Convey("Then its use is recorded", func() {
+				request("GET", "/devices", "", apiKeyHeader, key)
+				stored, _ := store.APIKey(context.Background(), issued.ID)
+				So(stored.LastUsed, ShouldNotBeEmpty)
+			})
+
+			Convey("Then it is limited to its requests per minute", func() {
+				So(request("GET", "/devices", "", apiKeyHeader, key).Code, ShouldEqual, 200)
+				So(request("GET", "/devices", "", apiKeyHeader, key).Code, ShouldEqual, 200)
+				w := request("GET", "/devices", "", apiKeyHeader, key)
+				So(w.Code, ShouldEqual, 429)
+				So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+			})
+
+			Convey("Then it stops working once revoked", func() {
+				So(request("DELETE", "/apikeys/"+issued.ID, "", "Authorization", "Bearer "+admin).Code, ShouldEqual, 204)
+				So(request("GET", "/devices", "", apiKeyHeader, key).Code, ShouldEqual, 401)
+			})
+		})
+
+		Convey("When another organisation manages keys", func() {
+			key, issued := issue(`{"name":"river logger","scopes":["read:readings"]}`)
+			list := func(token string) []apiKey {
+				var resp struct {
+					Items []apiKey `json:"items"`
+				}
+				json.Unmarshal(request("GET", "/apikeys", "", "Authorization", "Bearer "+token).Body.Bytes(), &resp)
+				return resp.Items
+			}
+
+			Convey("Then it can neither see nor revoke them", func() {
+				So(list(medway), ShouldBeEmpty)
+				So(list(admin), ShouldHaveLength, 1)
+				So(request("DELETE", "/apikeys/"+issued.ID, "", "Authorization", "Bearer "+medway).Code, ShouldEqual, 404)
+				So(request("GET", "/devices", "", apiKeyHeader, key).Code, ShouldEqual, 200)
+			})
+
+			Convey("Then full admins can see and revoke every key", func() {
+				So(list(operator), ShouldHaveLength, 1)
+				So(request("DELETE", "/apikeys/"+issued.ID, "", "Authorization", "Bearer "+operator).Code, ShouldEqual, 204)
+			})
+		})
+
+		Convey("When something other than a key is revoked", func() {
+			So(request("DELETE", "/apikeys/device:testsen1", "", "Authorization", "Bearer "+admin).Code, ShouldEqual, 404)
+			_, err := store.Device(context.Background(), "device:testsen1")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When a device management key issues another key", func() {
+			key, _ := issue(`{"name":"partner","scopes":["manage:devices"]}`)
+			w := request("POST", "/apikeys", `{"name":"copy","scopes":["manage:devices"]}`, apiKeyHeader, key)
+			So(w.Code, ShouldEqual, 403)
+		})
+
+		Convey("When a key is unknown or badly requested", func() {
+			So(request("GET", "/devices", "", apiKeyHeader, "knk_guess").Code, ShouldEqual, 401)
+			So(request("POST", "/apikeys", `{"name":"x","scopes":["root"]}`, "Authorization", "Bearer "+admin).Code, ShouldEqual, 400)
+			So(request("POST", "/apikeys", `{"name":"x","scopes":["read:readings"],"rateLimit":100000}`, "Authorization", "Bearer "+admin).Code, ShouldEqual, 400)
+		})
+	})
+
+	Convey("Subject: API key rate windows", t, func() {
+		now := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+		keys := newAPIKeyAuth(newMemoryStore())
+		keys.now = func() time.Time { return now }
+		k := apiKey{ID: "apikey:test", RateLimit: 1}
+
+		ok, _ := keys.allow(k)
+		So(ok, ShouldBeTrue)
+		now = now.Add(20 * time.Second)
+		ok, retryAfter := keys.allow(k)
+		So(ok, ShouldBeFalse)
+		So(retryAfter, ShouldEqual, 40*time.Second)
+		now = now.Add(40 * time.Second)
+		ok, _ = keys.allow(k)
+		So(ok, ShouldBeTrue)
+	})
+}
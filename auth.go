@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	auth0 "github.com/auth0-community/go-auth0"
+	"github.com/gin-gonic/gin"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Groups a token can carry. Device admins may also use every read-only endpoint,
+// admins (see groupAdmin) every endpoint.
+const (
+	groupRead        = "read-only"
+	groupDeviceAdmin = "device-admin"
+)
+
+const (
+	// defaultGroupsClaim is used unless auth0.groupsClaim is configured. Auth0 rules
+	// have to namespace custom claims, so deployments will usually override it.
+	defaultGroupsClaim = "groups"
+	// callerKey is the gin context key the authenticated caller is stored under
+	callerKey = "caller"
+)
+
+var (
+	validator   *auth0.JWTValidator
+	groupsClaim = defaultGroupsClaim
+)
+
+// caller - The authenticated identity behind a request
+type caller struct {
+	Subject string   `json:"sub"`
+	Org     string   `json:"org"`
+	Groups  []string `json:"groups"`
+	APIKey  string   `json:"apiKey,omitempty"` // ID of the API key used instead of a token
+}
+
+// inGroup reports whether the caller belongs to any of the groups
+func (c caller) inGroup(groups ...string) bool {
+	for _, want := range groups {
+		for _, have := range c.Groups {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// callerFrom returns the caller set by Auth0Groups, ok is false when auth is disabled
+func callerFrom(c *gin.Context) (who caller, ok bool) {
+	v, ok := c.Get(callerKey)
+	if !ok {
+		return who, false
+	}
+	who, ok = v.(caller)
+	return who, ok
+}
+
+// claimGroups reads a groups claim given either as a JSON array or, like the
+// OAuth scope claim, as a space separated string
+func claimGroups(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// LoadPublicKey loads a public key from PEM/DER-encoded data for jwt verifying
+func LoadPublicKey(data []byte) (interface{}, error) {
+	input := data
+
+	block, _ := pem.Decode(data)
+	if block != nil {
+		input = block.Bytes
+	}
+
+	// Try to load SubjectPublicKeyInfo
+	pub, err0 := x509.ParsePKIXPublicKey(input)
+	if err0 == nil {
+		return pub, nil
+	}
+
+	cert, err1 := x509.ParseCertificate(input)
+	if err1 == nil {
+		return cert.PublicKey, nil
+	}
+
+	return nil, fmt.Errorf("square/go-jose: parse error, got '%s' and '%s'", err0, err1)
+}
+
+// setupAuth0 builds the token validator, taking keys from a JWKS when one is
+// configured and from the PEM file in auth0.key otherwise
+func setupAuth0(config runtimeConfig) {
+	var secretProvider auth0.SecretProvider
+	if config.Auth0.JWKSURL != "" || config.Auth0.JWKSFile != "" {
+		jwks, err := newJWKSProvider(config.Auth0)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to load JWKS (%s)", err.Error()))
+		}
+		go jwks.refreshEvery(config.Auth0.jwksRefresh(), nil)
+		secretProvider = jwks
+	} else {
+		publicKeyLocation := config.Auth0.Key
+		//Creates a configuration with the Auth0 information
+		data, err := ioutil.ReadFile(publicKeyLocation)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to read public key from disk (%s)", publicKeyLocation))
+		}
+
+		secret, err := LoadPublicKey(data)
+		if err != nil {
+			panic("Invalid public key")
+		}
+		secretProvider = auth0.NewKeyProvider(secret)
+	}
+
+	configuration := auth0.NewConfiguration(secretProvider, []string{config.Auth0.audience()}, config.Auth0.issuer(), jose.RS256)
+	validator = auth0.NewValidator(configuration, nil)
+
+	groupsClaim = defaultGroupsClaim
+	if config.Auth0.GroupsClaim != "" {
+		groupsClaim = config.Auth0.GroupsClaim
+	}
+	orgClaim = defaultOrgClaim
+	if config.Auth0.OrgClaim != "" {
+		orgClaim = config.Auth0.OrgClaim
+	}
+}
+
+// Auth0Groups validates the bearer token, stores the caller on the context and
+// only lets the request through if the caller is in one of validGroups
+func Auth0Groups(validGroups ...string) gin.HandlerFunc {
+
+	return gin.HandlerFunc(func(c *gin.Context) {
+
+		tok, err := validator.ValidateRequest(c.Request)
+		if err != nil {
+			authFailures.WithLabelValues(authInvalidToken).Inc()
+			respondError(c, http.StatusUnauthorized, "invalid token")
+			requestLog(c).WithError(err).Info("invalid token")
+			return
+		}
+
+		claims := map[string]interface{}{}
+		err = validator.Claims(c.Request, tok, &claims)
+		if err != nil {
+			authFailures.WithLabelValues(authInvalidClaims).Inc()
+			respondError(c, http.StatusUnauthorized, "invalid token claims")
+			requestLog(c).WithError(err).Info("invalid token claims")
+			return
+		}
+
+		who := caller{Groups: claimGroups(claims[groupsClaim])}
+		who.Subject, _ = claims["sub"].(string)
+		if who.Org, _ = claims[orgClaim].(string); who.Org == "" {
+			who.Org = who.Subject
+		}
+		authorize(c, who, validGroups)
+	})
+}
+
+// authorize stores the caller on the context and continues the chain if the
+// caller is in one of validGroups, answering 403 otherwise
+func authorize(c *gin.Context, who caller, validGroups []string) {
+	c.Set(callerKey, who)
+
+	if len(validGroups) > 0 && !who.inGroup(validGroups...) {
+		authFailures.WithLabelValues(authInsufficientGroups).Inc()
+		respondErrorDetails(c, http.StatusForbidden, "insufficient permissions", gin.H{"required": validGroups})
+		return
+	}
+
+	c.Next()
+}
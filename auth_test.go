@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	auth0 "github.com/auth0-community/go-auth0"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testIssuer = "https://kentnetworkuk.eu.auth0.com/"
+
+// testSigner returns an RS256 signer for tokens and points the global validator at its key
+func testSigner(t *testing.T) jose.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration := auth0.NewConfiguration(auth0.NewKeyProvider(&key.PublicKey), []string{"kentnetwork"}, testIssuer, jose.RS256)
+	validator = auth0.NewValidator(configuration, nil)
+	return signer
+}
+
+// testToken signs a token for subject carrying extra claims
+func testToken(signer jose.Signer, subject string, extra map[string]interface{}) string {
+	claims := jwt.Claims{
+		Subject:  subject,
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{"kentnetwork"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	raw, _ := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+	return raw
+}
+
+func TestAuth0Groups(t *testing.T) {
+	signer := testSigner(t)
+	defer func() { validator, groupsClaim = nil, defaultGroupsClaim }()
+
+	config, _ := newMemoryTestConfig()
+	config.Auth0.Key = "test"
+	router := setupRouter(config)
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("Subject: Group based authorization", t, func() {
+
+		Convey("When no token is given", func() {
+			So(request("GET", "/devices", "").Code, ShouldEqual, 401)
+		})
+
+		Convey("When a read-only caller lists devices", func() {
+			token := testToken(signer, "auth0|reader", map[string]interface{}{"groups": []string{groupRead}})
+			So(request("GET", "/devices", token).Code, ShouldEqual, 200)
+
+			Convey("Then it may not change them", func() {
+				w := request("DELETE", "/devices/device:testsen1", token)
+				So(w.Code, ShouldEqual, 403)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "insufficient permissions")
+			})
+		})
+
+		Convey("When a caller has no groups", func() {
+			token := testToken(signer, "auth0|nobody", nil)
+			So(request("GET", "/devices", token).Code, ShouldEqual, 403)
+		})
+
+		Convey("When a device admin uses read and write endpoints", func() {
+			token := testToken(signer, "auth0|admin", map[string]interface{}{"groups": []string{groupDeviceAdmin}, "org": "kentnetwork"})
+			So(request("GET", "/devices", token).Code, ShouldEqual, 200)
+			So(request("DELETE", "/devices/device:testsen1", token).Code, ShouldEqual, 200)
+
+			Convey("Then it may not make service announcements", func() {
+				So(request("GET", "/announcements", token).Code, ShouldEqual, 403)
+			})
+		})
+
+		Convey("When groups come from a configured space separated claim", func() {
+			groupsClaim = "https://kent.network/permissions"
+			token := testToken(signer, "auth0|admin", map[string]interface{}{groupsClaim: "read-only device-admin"})
+			So(request("GET", "/devices", token).Code, ShouldEqual, 200)
+			groupsClaim = defaultGroupsClaim
+		})
+
+		Convey("When the caller is stored on the context", func() {
+			token := testToken(signer, "auth0|reader", map[string]interface{}{"groups": []string{groupRead}})
+			r := setupRouter(config)
+			var who caller
+			r.GET("/whoami", Auth0Groups(groupRead), func(c *gin.Context) {
+				who, _ = callerFrom(c)
+			})
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/whoami", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			So(who.Subject, ShouldEqual, "auth0|reader")
+			So(who.Groups, ShouldResemble, []string{groupRead})
+		})
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,24 +10,69 @@ import (
 	client "github.com/influxdata/influxdb/client/v2"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ttnConfig struct {
 	AppID         string `yaml:"appID"`
 	AppAccessKey  string `yaml:"appAccessKey"`
 	SdkClientName string `yaml:"sdkClientName"`
+	WebhookKey    string `yaml:"webhookKey,omitempty"` // Authorization header sent by the HTTP integration, the webhook is off when empty
+	MQTT          bool   `yaml:"mqtt,omitempty"`       // Also receive uplinks from the TTN MQTT broker
 	init          bool
 	client        ttnsdk.Client
 }
 
 func validConfig(config runtimeConfig) error {
+	if config.ServerBind == "" {
+		return errors.New("Parameter: missing server bind")
+	} else if config.TTN.AppAccessKey == "" {
+		return errors.New("Parameter: missing TTN app access key")
+	} else if config.TTN.AppID == "" {
+		return errors.New("Parameter: missing TTN app id")
+	}
+
+	if config.Auth0.JWKSRefresh != "" {
+		if d, err := time.ParseDuration(config.Auth0.JWKSRefresh); err != nil || d < minJWKSRefresh {
+			return fmt.Errorf("Parameter: auth0 jwksRefresh must be a duration of at least %s", minJWKSRefresh)
+		}
+	}
+
+	for name, d := range map[string]string{
+		"health warnLatency":     config.Health.WarnLatency,
+		"health degradedLatency": config.Health.DegradedLatency,
+		"health timeout":         config.Health.Timeout,
+		"couch timeout":          config.Couch.Timeout,
+		"influx timeout":         config.Influx.Timeout,
+	} {
+		if _, err := time.ParseDuration(d); d != "" && err != nil {
+			return fmt.Errorf("Parameter: %s must be a duration", name)
+		}
+	}
+
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("Parameter: %s", err)
+	}
+
+	switch config.Store {
+	case "memory":
+		// The in-memory store stands in for CouchDB and InfluxDB
+		return nil
+	case "":
+		return validBackendConfig(config)
+	default:
+		return fmt.Errorf("Parameter: unknown store %q", config.Store)
+	}
+}
+
+func validBackendConfig(config runtimeConfig) error {
 	if config.Couch.Host == "" {
 		return errors.New("Parameter: missing couch host")
-	} else if config.ServerBind == "" {
-		return errors.New("Parameter: missing server bind")
 	} else if config.Influx.Db == "" {
 		return errors.New("Parameter: missing influx db")
 	} else if config.Influx.Pwd == "" {
@@ -35,10 +81,6 @@ func validConfig(config runtimeConfig) error {
 		return errors.New("Parameter: missing influx user")
 	} else if config.Influx.Host == "" {
 		return errors.New("Parameter: missing influx host")
-	} else if config.TTN.AppAccessKey == "" {
-		return errors.New("Parameter: missing TTN app access key")
-	} else if config.TTN.AppID == "" {
-		return errors.New("Parameter: missing TTN app id")
 	}
 
 	return nil
@@ -58,12 +100,44 @@ func (ttn ttnConfig) connect() ttnsdk.Client {
 	return ttn.client
 }
 
+// ttnDevices - The part of the TTN device manager used to register and deregister devices
+type ttnDevices interface {
+	List(limit, offset uint64) (ttnsdk.DeviceList, error)
+	Get(devID string) (*ttnsdk.Device, error)
+	Set(dev *ttnsdk.Device) error
+	Delete(devID string) error
+}
+
+// deviceManager returns the TTN device manager, or the stand-in set on the
+// config, logging its calls with the request ID of ctx. done must be called
+// once the caller has finished with it.
+func (c runtimeConfig) deviceManager(ctx context.Context) (devices ttnDevices, done func(), err error) {
+	l := contextLog(ctx)
+	if c.devices != nil {
+		return instrumentedTTN{c.devices, l}, func() {}, nil
+	}
+	start := time.Now()
+	client := c.TTN.connect()
+	manager, err := client.ManageDevices()
+	observeTTN(l, "connect", "", start, err)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return instrumentedTTN{manager, l}, func() { client.Close() }, nil
+}
+
 type influxConfig struct {
-	Host   string `yaml:"host"`
-	User   string `yaml:"user"`
-	Pwd    string `yaml:"password"`
-	Db     string `yaml:"db"`
-	client client.Client
+	Host    string `yaml:"host"`
+	User    string `yaml:"user"`
+	Pwd     string `yaml:"password"`
+	Db      string `yaml:"db"`
+	Timeout string `yaml:"timeout,omitempty"` // Longest a query may take, defaults to 10s
+	client  client.Client
+}
+
+func (c influxConfig) timeout() time.Duration {
+	return durationOr(c.Timeout, defaultBackendTimeout)
 }
 
 func (c runtimeConfig) influxDBClient() (runtimeConfig, error) {
@@ -71,20 +145,47 @@ func (c runtimeConfig) influxDBClient() (runtimeConfig, error) {
 	config := client.HTTPConfig{
 		Addr:     i.Host,
 		Username: i.User,
-		Password: i.Pwd}
+		Password: i.Pwd,
+		Timeout:  i.timeout(),
+	}
 
 	client, err := client.NewHTTPClient(config)
 	c.Influx.client = client
 	return c, err
 }
 
+// writeInfluxDB writes a batch of points. The client's timeout bounds the write
+// as the client cannot take a context for it.
+func (c influxConfig) writeInfluxDB(ctx context.Context, bp client.BatchPoints) (err error) {
+	defer func(start time.Time) {
+		observeBackend(backendInflux, "write", start, err != nil)
+		logBackendCall(contextLog(ctx), backendInflux, "write", start, err, logFields{"points": len(bp.Points())})
+	}(time.Now())
+
+	if c.client == nil {
+		return errors.New("influx client not initialised")
+	}
+	return c.client.Write(bp)
+}
+
 // queryInfluxDB convenience function to query the influx database
-func (c influxConfig) queryInfluxDB(cmd string, database string) (res []client.Result, err error) {
+func (c influxConfig) queryInfluxDB(ctx context.Context, cmd string, database string) (res []client.Result, err error) {
+	defer func(start time.Time) {
+		observeBackend(backendInflux, "query", start, err != nil)
+		logBackendCall(contextLog(ctx), backendInflux, "query", start, err, logFields{"query": cmd})
+	}(time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	if c.client == nil {
+		return res, errors.New("influx client not initialised")
+	}
 	q := client.Query{
 		Command:  cmd,
 		Database: database,
 	}
-	if response, err := c.client.Query(q); err == nil {
+	if response, err := c.client.QueryCtx(ctx, q); err == nil {
 		if response.Error() != nil {
 			return res, response.Error()
 		}
@@ -95,45 +196,164 @@ func (c influxConfig) queryInfluxDB(cmd string, database string) (res []client.R
 	return res, nil
 }
 
+type healthConfig struct {
+	WarnLatency     string `yaml:"warnLatency,omitempty"`     // Services slower than this report warning, defaults to 500ms
+	DegradedLatency string `yaml:"degradedLatency,omitempty"` // Services slower than this report degraded, defaults to 2s
+	Timeout         string `yaml:"timeout,omitempty"`         // Services slower than this report error, defaults to 5s
+}
+
+func (h healthConfig) warnLatency() time.Duration {
+	return durationOr(h.WarnLatency, 500*time.Millisecond)
+}
+
+func (h healthConfig) degradedLatency() time.Duration {
+	return durationOr(h.DegradedLatency, 2*time.Second)
+}
+
+func (h healthConfig) timeout() time.Duration {
+	return durationOr(h.Timeout, 5*time.Second)
+}
+
+// latencyStatus grades a health check by its error and how long it took
+func (h healthConfig) latencyStatus(latency time.Duration, err error) string {
+	switch {
+	case err != nil:
+		return statusError
+	case latency > h.degradedLatency():
+		return statusDegraded
+	case latency > h.warnLatency():
+		return statusWarning
+	}
+	return statusOK
+}
+
+// defaultBackendTimeout bounds CouchDB and InfluxDB calls unless configured otherwise
+const defaultBackendTimeout = 10 * time.Second
+
+// backendTransport is shared by every outgoing HTTP call so connections to
+// CouchDB and Auth0 are pooled and reused across requests
+var backendTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   20,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   5 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// backendClient - Calls are bounded by their context rather than a client timeout
+var backendClient = &http.Client{Transport: backendTransport}
+
+// durationOr parses a duration from the config, using fallback when it is unset
+func durationOr(s string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
 type auth0Config struct {
-	Key string `yaml:"key,omitempty"`
+	Key         string `yaml:"key,omitempty"`         // PEM public key, used when no JWKS is configured
+	Issuer      string `yaml:"issuer,omitempty"`      // Defaults to the kentnetworkuk tenant
+	Audience    string `yaml:"audience,omitempty"`    // Defaults to "kentnetwork"
+	JWKSURL     string `yaml:"jwksURL,omitempty"`     // e.g. "https://kentnetworkuk.eu.auth0.com/.well-known/jwks.json"
+	JWKSFile    string `yaml:"jwksFile,omitempty"`    // Local key set, takes precedence over jwksURL
+	JWKSRefresh string `yaml:"jwksRefresh,omitempty"` // How often the key set is fetched again, defaults to 1h
+	GroupsClaim string `yaml:"groupsClaim,omitempty"` // Claim holding the caller's groups, defaults to "groups"
+	OrgClaim    string `yaml:"orgClaim,omitempty"`    // Claim holding the caller's organisation, defaults to "org"
+
+	// POST /login exchanges a username and password for a token with the
+	// password grant. It is disabled until a client ID is configured.
+	TokenURL     string `yaml:"tokenURL,omitempty"` // Defaults to the issuer's oauth/token
+	ClientID     string `yaml:"clientID,omitempty"`
+	ClientSecret string `yaml:"clientSecret,omitempty"`
 }
 
-type couchConfig struct {
-	Host string `yaml:"host"` //Host to connect to for CouchDB e.g. "http://couch.example.com"
+// enabled reports whether endpoints require a token
+func (a auth0Config) enabled() bool {
+	return a.Key != "" || a.JWKSURL != "" || a.JWKSFile != ""
 }
 
-func (c couchConfig) query(request string) (code int, response []byte, err error) {
-	request = c.Host + request
-	resp, err := http.Get(request)
-	if err != nil {
-		return 500, nil, err
+func (a auth0Config) issuer() string {
+	if a.Issuer == "" {
+		return "https://kentnetworkuk.eu.auth0.com/"
 	}
-	defer resp.Body.Close()
-	response, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return 500, nil, err
+	return a.Issuer
+}
+
+func (a auth0Config) audience() string {
+	if a.Audience == "" {
+		return "kentnetwork"
 	}
-	code = resp.StatusCode
-	return code, response, err
+	return a.Audience
+}
+
+func (a auth0Config) tokenURL() string {
+	if a.TokenURL == "" {
+		return strings.TrimSuffix(a.issuer(), "/") + "/oauth/token"
+	}
+	return a.TokenURL
 }
 
-func (c couchConfig) put(request string, body interface{}) (code int, response []byte, err error) {
-	request = c.Host + request
+func (a auth0Config) jwksRefresh() time.Duration {
+	return durationOr(a.JWKSRefresh, defaultJWKSRefresh)
+}
+
+type couchConfig struct {
+	Host    string `yaml:"host"`              //Host to connect to for CouchDB e.g. "http://couch.example.com"
+	Timeout string `yaml:"timeout,omitempty"` // Longest a request may take, defaults to 10s
+}
+
+func (c couchConfig) timeout() time.Duration {
+	return durationOr(c.Timeout, defaultBackendTimeout)
+}
 
-	client := &http.Client{}
+func (c couchConfig) query(ctx context.Context, request string) (code int, response []byte, err error) {
+	return c.do(ctx, http.MethodGet, request, nil)
+}
+
+func (c couchConfig) put(ctx context.Context, request string, body interface{}) (code int, response []byte, err error) {
 	data, err := json.Marshal(body)
 	if err != nil {
-		// handle error
-		log.Fatal(err)
+		return 500, nil, err
 	}
-	req, err := http.NewRequest(http.MethodPut, request, bytes.NewReader(data))
+	return c.do(ctx, http.MethodPut, request, data)
+}
+
+func (c couchConfig) delete(ctx context.Context, request string) (code int, response []byte, err error) {
+	return c.do(ctx, http.MethodDelete, request, nil)
+}
+
+// do sends a request to CouchDB, giving up after the couch timeout or when ctx
+// is cancelled. The request ID is forwarded and the call timed and logged; path
+// is logged rather than the URL as the host may carry credentials.
+func (c couchConfig) do(ctx context.Context, method, path string, body []byte) (code int, response []byte, err error) {
+	operation := strings.ToLower(method)
+	defer func(start time.Time) {
+		observeBackend(backendCouch, operation, start, err != nil || code >= 500)
+		failure := err
+		if failure == nil && code >= 500 {
+			failure = fmt.Errorf("couchdb: status %d", code)
+		}
+		logBackendCall(contextLog(ctx), backendCouch, operation, start, failure, logFields{"path": path, "status": code})
+	}(time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Host+path, bytes.NewReader(body))
 	if err != nil {
-		// handle error
-		log.Fatal(err)
+		return 500, nil, err
 	}
-	resp, err := client.Do(req)
-
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := backendClient.Do(req)
 	if err != nil {
 		return 500, nil, err
 	}
@@ -153,6 +373,13 @@ type runtimeConfig struct {
 	Auth0      auth0Config  `yaml:"auth0,omitempty"`
 	Influx     influxConfig `yaml:"influx"`
 	TTN        ttnConfig    `yaml:"ttn"`
+	Health     healthConfig `yaml:"health,omitempty"`
+	Store      string       `yaml:"store,omitempty"`     // Set to "memory" to run without CouchDB and InfluxDB
+	StoreSeed  string       `yaml:"storeSeed,omitempty"` // JSON file used to populate the in-memory store
+	LogLevel   string       `yaml:"logLevel,omitempty"`  // debug, info (default), warn or error
+	metadata   MetadataStore
+	readings   ReadingStore
+	devices    ttnDevices // Replaces the TTN device manager when set
 }
 
 // Configuration options that can be set by "flags"
@@ -178,21 +405,44 @@ func importEnvConf() runtimeConfig {
 	var config runtimeConfig
 
 	config.Couch.Host = os.Getenv("COUCHHOST")
+	config.Couch.Timeout = os.Getenv("COUCHTIMEOUT")
 	config.Influx = influxConfig{
-		Db:   os.Getenv("INFLUXDB"),
-		Host: os.Getenv("INFLUXHOST"),
-		Pwd:  os.Getenv("INFLUXPWD"),
-		User: os.Getenv("INFLUXUSER"),
+		Db:      os.Getenv("INFLUXDB"),
+		Host:    os.Getenv("INFLUXHOST"),
+		Pwd:     os.Getenv("INFLUXPWD"),
+		User:    os.Getenv("INFLUXUSER"),
+		Timeout: os.Getenv("INFLUXTIMEOUT"),
 	}
 
 	config.TTN = ttnConfig{
 		AppAccessKey:  os.Getenv("TTNAPPKEY"),
 		AppID:         os.Getenv("TTNAPPID"),
 		SdkClientName: os.Getenv("TTNSDKCLIENTNAME"),
+		WebhookKey:    os.Getenv("TTNWEBHOOKKEY"),
+	}
+	config.TTN.MQTT, _ = strconv.ParseBool(os.Getenv("TTNMQTT"))
+
+	config.Health = healthConfig{
+		WarnLatency:     os.Getenv("HEALTHWARNLATENCY"),
+		DegradedLatency: os.Getenv("HEALTHDEGRADEDLATENCY"),
+		Timeout:         os.Getenv("HEALTHTIMEOUT"),
 	}
 
 	config.ServerBind = os.Getenv("SERVERBIND")
+	config.Store = os.Getenv("STORE")
+	config.StoreSeed = os.Getenv("STORESEED")
+	config.LogLevel = os.Getenv("LOGLEVEL")
 	config.Auth0.Key = os.Getenv("AUTH0KEY")
+	config.Auth0.Issuer = os.Getenv("AUTH0ISSUER")
+	config.Auth0.Audience = os.Getenv("AUTH0AUDIENCE")
+	config.Auth0.JWKSURL = os.Getenv("AUTH0JWKSURL")
+	config.Auth0.JWKSFile = os.Getenv("AUTH0JWKSFILE")
+	config.Auth0.JWKSRefresh = os.Getenv("AUTH0JWKSREFRESH")
+	config.Auth0.GroupsClaim = os.Getenv("AUTH0GROUPSCLAIM")
+	config.Auth0.OrgClaim = os.Getenv("AUTH0ORGCLAIM")
+	config.Auth0.TokenURL = os.Getenv("AUTH0TOKENURL")
+	config.Auth0.ClientID = os.Getenv("AUTH0CLIENTID")
+	config.Auth0.ClientSecret = os.Getenv("AUTH0CLIENTSECRET")
 
 	config = config.init()
 
@@ -204,6 +454,20 @@ func (c runtimeConfig) init() runtimeConfig {
 	if err := validConfig(c); err != nil {
 		panic(err)
 	}
+	sink.min, _ = parseLogLevel(c.LogLevel)
+
+	if c.Store == "memory" {
+		m := newMemoryStore()
+		if c.StoreSeed != "" {
+			var err error
+			if m, err = memoryStoreFromFile(c.StoreSeed); err != nil {
+				panic(fmt.Sprintf("Error loading store seed (%s:%s)", c.StoreSeed, err.Error()))
+			}
+		}
+		c.metadata = m
+		c.readings = m
+		return c
+	}
 
 	var err error
 	if c, err = c.influxDBClient(); err != nil {
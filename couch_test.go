@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// couchEmit - The keys a view emits for a document, one row each
+type couchEmit func(id string, doc map[string]interface{}) []interface{}
+
+func isDeviceDoc(id string) bool {
+	return strings.HasPrefix(id, "device:") && !strings.Contains(id, ":sensorid:")
+}
+
+func isSensorDoc(id string) bool {
+	return strings.Contains(id, ":sensorid:")
+}
+
+// couchViews - The views of the kentnetwork design documents, by design
+// document and view name
+var couchViews = map[string]couchEmit{
+	"devices/getDevices": func(id string, doc map[string]interface{}) []interface{} {
+		if isDeviceDoc(id) {
+			return []interface{}{id}
+		}
+		return nil
+	},
+	"devices/getByOwner": func(id string, doc map[string]interface{}) []interface{} {
+		if !isDeviceDoc(id) {
+			return nil
+		}
+		keys := []interface{}{doc["owner"]}
+		if doc["public"] == true {
+			keys = append(keys, true)
+		}
+		return keys
+	},
+	"devices/getByTTNDevID": func(id string, doc map[string]interface{}) []interface{} {
+		if ttn, ok := doc["ttn"].(map[string]interface{}); ok && isDeviceDoc(id) && ttn["devId"] != nil {
+			return []interface{}{ttn["devId"]}
+		}
+		return nil
+	},
+	"sensors/getSensors": func(id string, doc map[string]interface{}) []interface{} {
+		if isSensorDoc(id) {
+			return []interface{}{id}
+		}
+		return nil
+	},
+	"sensors/getByDeviceID": func(id string, doc map[string]interface{}) []interface{} {
+		if isSensorDoc(id) {
+			return []interface{}{id}
+		}
+		return nil
+	},
+}
+
+// fakeCouch - A CouchDB stand-in holding the kentnetwork database in memory,
+// with document revisions and the views in couchViews
+type fakeCouch struct {
+	*httptest.Server
+	mu   sync.Mutex
+	docs map[string]map[string]interface{}
+	revs int
+	// paths lists the views and documents requested, to check what was read
+	paths []string
+}
+
+func newFakeCouch() *fakeCouch {
+	f := &fakeCouch{docs: map[string]map[string]interface{}{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// put stores a document as it is, outside of any request
+func (f *fakeCouch) put(id string, doc interface{}) {
+	data, _ := json.Marshal(doc)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revs++
+	fields["_id"], fields["_rev"] = id, strconv.Itoa(f.revs)+"-fake"
+	f.docs[id] = fields
+}
+
+// doc returns a stored document, nil when there is none
+func (f *fakeCouch) doc(id string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.docs[id]
+}
+
+func (f *fakeCouch) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.Path, "/kentnetwork/")
+	switch {
+	case r.URL.Path == "/":
+		w.Write([]byte(`{"couchdb":"Welcome"}`))
+	case path == "_all_docs":
+		f.view(w, r, func(id string, doc map[string]interface{}) []interface{} { return []interface{}{id} })
+	case strings.HasPrefix(path, "_design/"):
+		parts := strings.Split(path, "/") // _design, devices, _view, getDevices
+		emit, ok := couchViews[parts[1]+"/"+parts[len(parts)-1]]
+		if !ok {
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+			return
+		}
+		f.view(w, r, emit)
+	default:
+		f.document(w, r, path)
+	}
+}
+
+func (f *fakeCouch) document(w http.ResponseWriter, r *http.Request, id string) {
+	current, exists := f.docs[id]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(current)
+	case http.MethodPut:
+		var doc map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &doc); err != nil {
+			http.Error(w, `{"error":"bad_request"}`, http.StatusBadRequest)
+			return
+		}
+		if exists && doc["_rev"] != current["_rev"] || !exists && doc["_rev"] != nil {
+			http.Error(w, `{"error":"conflict"}`, http.StatusConflict)
+			return
+		}
+		f.revs++
+		doc["_id"], doc["_rev"] = id, strconv.Itoa(f.revs)+"-fake"
+		f.docs[id] = doc
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]})
+	case http.MethodDelete:
+		if !exists {
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("rev") != current["_rev"] {
+			http.Error(w, `{"error":"conflict"}`, http.StatusConflict)
+			return
+		}
+		delete(f.docs, id)
+		w.Write([]byte(`{"ok":true}`))
+	default:
+		http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// view answers a view query, honouring key, keys, startkey, endkey, startkey_docid and limit
+func (f *fakeCouch) view(w http.ResponseWriter, r *http.Request, emit couchEmit) {
+	type row struct {
+		ID  string                 `json:"id"`
+		Key interface{}            `json:"key"`
+		Doc map[string]interface{} `json:"doc,omitempty"`
+	}
+	param := func(name string) (v interface{}, ok bool) {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			return nil, false
+		}
+		json.Unmarshal([]byte(raw), &v)
+		return v, true
+	}
+
+	var rows []row
+	for id, doc := range f.docs {
+		for _, key := range emit(id, doc) {
+			rows = append(rows, row{ID: id, Key: key, Doc: doc})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if c := couchCollate(rows[i].Key, rows[j].Key); c != 0 {
+			return c < 0
+		}
+		return rows[i].ID < rows[j].ID
+	})
+
+	var out []row
+	for _, rw := range rows {
+		if key, ok := param("key"); ok && couchCollate(rw.Key, key) != 0 {
+			continue
+		}
+		if keys, ok := param("keys"); ok {
+			found := false
+			for _, key := range keys.([]interface{}) {
+				found = found || couchCollate(rw.Key, key) == 0
+			}
+			if !found {
+				continue
+			}
+		}
+		if start, ok := param("startkey"); ok {
+			c := couchCollate(rw.Key, start)
+			if c < 0 || c == 0 && rw.ID < r.URL.Query().Get("startkey_docid") {
+				continue
+			}
+		}
+		if end, ok := param("endkey"); ok && couchCollate(rw.Key, end) > 0 {
+			continue
+		}
+		if r.URL.Query().Get("include_docs") != "true" {
+			rw.Doc = nil
+		}
+		out = append(out, rw)
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit < len(out) {
+		out = out[:limit]
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"total_rows": len(rows), "offset": 0, "rows": out})
+}
+
+// couchCollate orders view keys the way CouchDB does for the types our views
+// emit: null, then booleans, then strings, then arrays compared element by
+// element, then objects
+func couchCollate(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case string:
+			return 2
+		case []interface{}:
+			return 3
+		}
+		return 4
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if a {
+			return 1
+		}
+		return -1
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := couchCollate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	}
+	return 0
+}
+
+func TestCouchStore(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("Subject: Documents in CouchDB", t, func() {
+		couch := newFakeCouch()
+		defer couch.Close()
+		store := couchConfig{Host: couch.URL}
+		couch.put("device:testsen1", device{ID: "device:testsen1", HardwareRef: "ultrasonic", Owner: "kentnetwork"})
+		couch.put("announcement:1", serviceMessage{ID: "announcement:1", Title: "Maintenance", Message: "Tonight", Created: time.Now()})
+
+		Convey("When an announcement is updated", func() {
+			title := "Maintenance overrun"
+			m, err := store.UpdateServiceMessage(ctx, "announcement:1", announcementPatch{Title: &title}, time.Now())
+			So(err, ShouldBeNil)
+			So(m.Title, ShouldEqual, title)
+			So(couch.doc("announcement:1")["title"], ShouldEqual, title)
+		})
+
+		Convey("When another document is updated as an announcement", func() {
+			title, message := "Hijacked", "Overwritten"
+			_, err := store.UpdateServiceMessage(ctx, "device:testsen1", announcementPatch{Title: &title, Message: &message}, time.Now())
+
+			Convey("Then it is not found and left untouched", func() {
+				So(err, ShouldEqual, errNotFound)
+				So(couch.doc("device:testsen1")["title"], ShouldBeNil)
+				So(couch.doc("device:testsen1")["hardwareRef"], ShouldEqual, "ultrasonic")
+			})
+
+			Convey("Then the announcement endpoints answer 404", func() {
+				router := setupRouter(runtimeConfig{Couch: store})
+				for _, method := range []string{"PATCH", "DELETE"} {
+					w := httptest.NewRecorder()
+					req, _ := http.NewRequest(method, "/announcements/device:testsen1", strings.NewReader(`{"title":"Hijacked","message":"Overwritten"}`))
+					req.Header.Set("Content-Type", "application/json")
+					router.ServeHTTP(w, req)
+					So(w.Code, ShouldEqual, 404)
+				}
+				So(couch.doc("device:testsen1")["expires"], ShouldBeNil)
+			})
+		})
+
+		Convey("When a device is made public", func() {
+			public, ref := true, "radar"
+			d, err := store.UpdateDevice(ctx, "device:testsen1", devicePatch{Public: &public, HardwareRef: &ref})
+			So(err, ShouldBeNil)
+			So(d.Public, ShouldBeTrue)
+
+			Convey("Then it is stored with the rest of the patch", func() {
+				stored, err := store.Device(ctx, "device:testsen1")
+				So(err, ShouldBeNil)
+				So(stored.Public, ShouldBeTrue)
+				So(stored.HardwareRef, ShouldEqual, "radar")
+				So(stored.Owner, ShouldEqual, "kentnetwork")
+			})
+
+			Convey("Then it can be made private again", func() {
+				public = false
+				d, err := store.UpdateDevice(ctx, "device:testsen1", devicePatch{Public: &public})
+				So(err, ShouldBeNil)
+				So(d.Public, ShouldBeFalse)
+				So(couch.doc("device:testsen1")["public"], ShouldEqual, false)
+			})
+		})
+
+		Convey("When sensor numbers are handed out", func() {
+			n, err := store.NextSensorNumber(ctx, "device:testsen1", 2)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+
+			Convey("Then they keep counting after the sensors are removed", func() {
+				n, err := store.NextSensorNumber(ctx, "device:testsen1", 0)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 4)
+				So(couch.doc("device:testsen1")["lastSensorNumber"], ShouldEqual, 4)
+			})
+
+			Convey("Then an unknown device has none", func() {
+				_, err := store.NextSensorNumber(ctx, "device:missing", 0)
+				So(err, ShouldEqual, errNotFound)
+			})
+		})
+
+		Convey("When other documents are used as devices or sensors", func() {
+			couch.put("device:testsen1:sensorid:1", sensor{ID: "device:testsen1:sensorid:1", ParentDevice: "device:testsen1", SensorType: "riverLevel", Unit: "m"})
+			router := setupRouter(runtimeConfig{Couch: store})
+			for _, r := range []struct{ method, path, body string }{
+				{"GET", "/devices/announcement:1", ""},
+				{"PATCH", "/devices/announcement:1", `{"batteryType":"AA"}`},
+				{"POST", "/devices/announcement:1/status", `{"type":"Active"}`},
+				{"DELETE", "/devices/announcement:1", ""},
+				{"PATCH", "/devices/device:testsen1:sensorid:1", `{"batteryType":"AA"}`},
+				{"GET", "/sensors/device:testsen1", ""},
+				{"PATCH", "/sensors/announcement:1", `{"unit":"mm"}`},
+				{"DELETE", "/sensors/announcement:1", ""},
+			} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(r.method, r.path, strings.NewReader(r.body))
+				req.Header.Set("Content-Type", "application/json")
+				router.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 404)
+			}
+
+			Convey("Then they are left untouched", func() {
+				So(couch.doc("announcement:1"), ShouldNotBeNil)
+				So(couch.doc("announcement:1")["batteryType"], ShouldBeNil)
+				So(couch.doc("announcement:1")["status"], ShouldBeNil)
+				So(couch.doc("device:testsen1:sensorid:1")["batteryType"], ShouldBeNil)
+				So(couch.doc("device:testsen1:sensorid:1")["unit"], ShouldEqual, "m")
+			})
+		})
+
+		Convey("When a device is created through the API", func() {
+			router := setupRouter(runtimeConfig{Couch: store, devices: newFakeTTN()})
+			send := func(method, path, body string) (int, []byte) {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, path, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				router.ServeHTTP(w, req)
+				return w.Code, w.Body.Bytes()
+			}
+			code, body := send("POST", "/devices", `{"hardwareRef":"ultrasonic","owner":"medway"}`)
+			So(code, ShouldEqual, 201)
+			var created struct {
+				Items device `json:"items"`
+			}
+			So(json.Unmarshal(body, &created), ShouldBeNil)
+
+			Convey("Then it is stored as a device document and listed", func() {
+				So(created.Items.ID, ShouldEqual, "device:"+created.Items.Ttn.DevID)
+				So(couch.doc(created.Items.ID), ShouldNotBeNil)
+
+				code, body := send("GET", "/devices", "")
+				So(code, ShouldEqual, 200)
+				var listed struct {
+					Items []device `json:"items"`
+				}
+				So(json.Unmarshal(body, &listed), ShouldBeNil)
+				So(listed.Items, ShouldHaveLength, 2)
+				So(listed.Items[0].ID == created.Items.ID || listed.Items[1].ID == created.Items.ID, ShouldBeTrue)
+
+				ids, err := store.VisibleDeviceIDs(ctx, "medway")
+				So(err, ShouldBeNil)
+				So(ids, ShouldResemble, []string{created.Items.ID})
+			})
+		})
+
+		Convey("When an uplink arrives for a device", func() {
+			couch.put("device:8f2c", device{ID: "device:8f2c", HardwareRef: "ultrasonic", Ttn: &ttn{DevID: "8f2c"}})
+			couch.put("device:legacy", device{ID: "device:legacy", HardwareRef: "weather", Ttn: &ttn{DevID: "legacy-node"}})
+			couch.paths = nil
+
+			Convey("Then it is found by its dev_id without reading every device", func() {
+				d, err := uplinkDevice(ctx, store, "legacy-node")
+				So(err, ShouldBeNil)
+				So(d.ID, ShouldEqual, "device:legacy")
+				d, err = uplinkDevice(ctx, store, "8f2c")
+				So(err, ShouldBeNil)
+				So(d.ID, ShouldEqual, "device:8f2c")
+				So(couch.paths, ShouldResemble, []string{
+					"/kentnetwork/_design/devices/_view/getByTTNDevID",
+					"/kentnetwork/_design/devices/_view/getByTTNDevID",
+				})
+			})
+
+			Convey("Then a device without TTN metadata is found by its ID", func() {
+				d, err := uplinkDevice(ctx, store, "device:testsen1")
+				So(err, ShouldBeNil)
+				So(d.ID, ShouldEqual, "device:testsen1")
+				_, err = uplinkDevice(ctx, store, "unknown-node")
+				So(err, ShouldEqual, errNotFound)
+			})
+		})
+
+		Convey("When something other than an API key is revoked", func() {
+			So(store.RemoveAPIKey(ctx, "device:testsen1"), ShouldEqual, errNotFound)
+			So(couch.doc("device:testsen1"), ShouldNotBeNil)
+		})
+
+		Convey("When devices are listed a page at a time", func() {
+			for i := 2; i <= 9; i++ {
+				id := "device:testsen" + strconv.Itoa(i)
+				owner := "kentnetwork"
+				if i%2 == 0 {
+					owner = "medway"
+				}
+				couch.put(id, device{ID: id, HardwareRef: "ultrasonic", Owner: owner, Public: i == 4})
+				couch.put(id+":sensorid:1", sensor{ID: id + ":sensorid:1", ParentDevice: id, SensorType: "riverLevel"})
+			}
+			medway := visibility{Org: "medway", Restricted: true}
+
+			Convey("Then a filtered listing resumes where the page ended", func() {
+				var ids []string
+				p := pageRequest{Limit: 2}
+				for page := 0; page < 5; page++ {
+					devices, next, err := store.Devices(ctx, deviceFilter{Visible: medway}, p)
+					So(err, ShouldBeNil)
+					So(len(devices), ShouldBeLessThanOrEqualTo, 2)
+					for _, d := range devices {
+						ids = append(ids, d.ID)
+					}
+					if next.isZero() {
+						break
+					}
+					p.Cursor = next
+				}
+				So(ids, ShouldResemble, []string{"device:testsen2", "device:testsen4", "device:testsen6", "device:testsen8"})
+			})
+
+			Convey("Then sensors are listed a page at a time", func() {
+				sensors, next, err := store.Sensors(ctx, sensorFilter{}, pageRequest{Limit: 3})
+				So(err, ShouldBeNil)
+				So(len(sensors), ShouldEqual, 3)
+				So(sensors[0].ID, ShouldEqual, "device:testsen2:sensorid:1")
+
+				rest, next, err := store.Sensors(ctx, sensorFilter{}, pageRequest{Limit: 10, Cursor: next})
+				So(err, ShouldBeNil)
+				So(len(rest), ShouldEqual, 5)
+				So(next.isZero(), ShouldBeTrue)
+			})
+
+			Convey("Then the sensors an organisation sees are found by owner, not by reading every device", func() {
+				couch.paths = nil
+				f, err := visibleSensors(ctx, store, visibility{Org: "kentnetwork", Restricted: true})
+				So(err, ShouldBeNil)
+				So(f.ParentDevices, ShouldResemble, map[string]bool{
+					"device:testsen1": true, "device:testsen3": true, "device:testsen4": true,
+					"device:testsen5": true, "device:testsen7": true, "device:testsen9": true,
+				})
+				So(couch.paths, ShouldResemble, []string{"/kentnetwork/_design/devices/_view/getByOwner"})
+			})
+		})
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// tipsPerMm - Times the tipping bucket tips for each mm of rain
+const tipsPerMm = 5
+
+func init() {
+	registerDecoder("raingauge", decodeRainGauge)
+}
+
+// decodeRainGauge - The tipping bucket rain gauge sends the number of tips since
+// its last uplink followed by its battery voltage in mV, each a big-endian uint16
+func decodeRainGauge(payload []byte) ([]decodedValue, error) {
+	if len(payload) != 4 {
+		return nil, fmt.Errorf("raingauge payload is %d bytes, expected 4", len(payload))
+	}
+	tips := binary.BigEndian.Uint16(payload[0:2])
+	return []decodedValue{
+		{SensorType: "rainfall", Unit: "mm", Value: float64(tips) / tipsPerMm},
+		{SensorType: "batteryVoltage", Unit: "V", Value: float64(binary.BigEndian.Uint16(payload[2:4])) / 1000},
+	}, nil
+}
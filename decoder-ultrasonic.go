@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+func init() {
+	registerDecoder("ultrasonic", decodeUltrasonic)
+}
+
+// decodeUltrasonic - The ultrasonic level sensor sends the river level in mm
+// followed by its battery voltage in mV, each a big-endian uint16
+func decodeUltrasonic(payload []byte) ([]decodedValue, error) {
+	if len(payload) != 4 {
+		return nil, fmt.Errorf("ultrasonic payload is %d bytes, expected 4", len(payload))
+	}
+	return []decodedValue{
+		{SensorType: "riverLevel", Unit: "mm", Value: float64(binary.BigEndian.Uint16(payload[0:2]))},
+		{SensorType: "batteryVoltage", Unit: "V", Value: float64(binary.BigEndian.Uint16(payload[2:4])) / 1000},
+	}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// decodedValue - A value decoded from an uplink payload, stored as a reading of
+// the device's sensor of that type. An empty unit means the sensor's own unit.
+type decodedValue struct {
+	SensorType string  `json:"sensorType"`
+	Unit       string  `json:"unit,omitempty"`
+	Value      float64 `json:"value"`
+}
+
+// payloadDecoder turns the raw bytes of an uplink into sensor values
+type payloadDecoder func(payload []byte) ([]decodedValue, error)
+
+// decoderRegistry - The payload decoder of each hardware type, keyed by hardwareRef
+type decoderRegistry struct {
+	mu       sync.RWMutex
+	decoders map[string]payloadDecoder
+}
+
+var decoders = &decoderRegistry{decoders: map[string]payloadDecoder{}}
+
+// registerDecoder makes a decoder available to devices with the given
+// hardwareRef. Hardware types register theirs from an init function, see
+// decoder-ultrasonic.go. Registering a hardwareRef twice panics.
+func registerDecoder(hardwareRef string, decode payloadDecoder) {
+	decoders.mu.Lock()
+	defer decoders.mu.Unlock()
+	if decode == nil {
+		panic("decoder: nil decoder for " + hardwareRef)
+	}
+	if _, dup := decoders.decoders[hardwareRef]; dup {
+		panic("decoder: registered twice for " + hardwareRef)
+	}
+	decoders.decoders[hardwareRef] = decode
+}
+
+// lookup returns the decoder registered for a hardwareRef
+func (r *decoderRegistry) lookup(hardwareRef string) (payloadDecoder, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	decode, ok := r.decoders[hardwareRef]
+	return decode, ok
+}
+
+// hardwareRefs lists the hardware with a registered decoder, sorted
+func (r *decoderRegistry) hardwareRefs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	refs := make([]string, 0, len(r.decoders))
+	for ref := range r.decoders {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// decodeUplink decodes an uplink payload with the decoder registered for the
+// hardware. Hardware without one relies on TTN's payload function naming each
+// value by sensor type in fields.
+func decodeUplink(hardwareRef string, payload []byte, fields map[string]interface{}) ([]decodedValue, error) {
+	if decode, ok := decoders.lookup(hardwareRef); ok {
+		return decode(payload)
+	}
+	return decodePayloadFields(fields)
+}
+
+// decodePayloadFields takes every numeric payload field named after a sensor type
+func decodePayloadFields(fields map[string]interface{}) ([]decodedValue, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("no decoder for this hardware and the uplink has no payload fields")
+	}
+	var values []decodedValue
+	for name, v := range fields {
+		if _, ok := sensorUnits[name]; !ok {
+			continue
+		}
+		if f, ok := v.(float64); ok {
+			values = append(values, decodedValue{SensorType: name, Value: f})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].SensorType < values[j].SensorType })
+	return values, nil
+}
+
+// unitScales - Factors converting a decoded value into a sensor's unit, keyed by from and to unit
+var unitScales = map[[2]string]float64{
+	{"mm", "m"}: 0.001,
+	{"m", "mm"}: 1000,
+}
+
+// inUnit returns a decoded value in the given unit, false when it cannot be converted
+func (v decodedValue) inUnit(unit string) (float64, bool) {
+	if v.Unit == "" || v.Unit == unit {
+		return v.Value, true
+	}
+	scale, ok := unitScales[[2]string{v.Unit, unit}]
+	return v.Value * scale, ok
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPayloadDecoders(t *testing.T) {
+
+	Convey("Subject: Decoding uplink payloads by hardware type", t, func() {
+
+		Convey("When the hardware has a registered decoder", func() {
+			values, err := decodeUplink("raingauge", []byte{0x00, 0x03, 0x0D, 0xAC}, nil)
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []decodedValue{
+				{SensorType: "rainfall", Unit: "mm", Value: 0.6},
+				{SensorType: "batteryVoltage", Unit: "V", Value: 3.5},
+			})
+			So(decoders.hardwareRefs(), ShouldContain, "ultrasonic")
+		})
+
+		Convey("When the hardware has no decoder of its own", func() {
+			values, err := decodeUplink("unknown", nil, map[string]interface{}{"rainfall": 0.4, "status": "ok"})
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []decodedValue{{SensorType: "rainfall", Value: 0.4}})
+
+			_, err = decodeUplink("unknown", []byte{1, 2}, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When a hardware type registers twice", func() {
+			So(func() { registerDecoder("ultrasonic", decodeUltrasonic) }, ShouldPanic)
+		})
+
+		Convey("When a value is converted to a sensor's unit", func() {
+			v := decodedValue{SensorType: "riverLevel", Unit: "mm", Value: 1500}
+			m, ok := v.inUnit("m")
+			So(ok, ShouldBeTrue)
+			So(m, ShouldEqual, 1.5)
+			_, ok = v.inUnit("C")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Subject: Trying a payload with POST /decoders/:hardwareRef/test", t, func() {
+		config, _ := newMemoryTestConfig()
+		router := setupRouter(config)
+
+		send := func(path, body string) (*httptest.ResponseRecorder, []decodedValue) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			var resp struct {
+				Items []decodedValue `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w, resp.Items
+		}
+
+		Convey("When a hex payload is decoded", func() {
+			w, values := send("/decoders/ultrasonic/test", `{"payload":"0x04 B0 0E 10"}`)
+			So(w.Code, ShouldEqual, 200)
+			So(values, ShouldResemble, []decodedValue{
+				{SensorType: "riverLevel", Unit: "mm", Value: 1200},
+				{SensorType: "batteryVoltage", Unit: "V", Value: 3.6},
+			})
+		})
+
+		Convey("When the payload is refused", func() {
+			w, _ := send("/decoders/ultrasonic/test", `{"payload":"zz"}`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("/decoders/ultrasonic/test", `{"payload":"04b0"}`)
+			So(w.Code, ShouldEqual, 400)
+			So(errorMessage(w.Body.Bytes()), ShouldEqual, "Payload could not be decoded")
+			w, _ = send("/decoders/ultrasonic/test", `{}`)
+			So(w.Code, ShouldEqual, 400)
+		})
+
+		Convey("When the hardware has no decoder", func() {
+			w, _ := send("/decoders/teapot/test", `{"payload":"00"}`)
+			So(w.Code, ShouldEqual, 404)
+			So(w.Body.String(), ShouldContainSubstring, "raingauge")
+		})
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeInflux - An InfluxDB /query endpoint answering sensor reading queries from
+// a fixed set of newest-first readings, honouring the sensor_id tag and LIMIT
+func fakeInflux(readings map[string][]reading) *httptest.Server {
+	sensorTag := regexp.MustCompile(`"sensor_id" = '([^']*)'`)
+	limit := regexp.MustCompile(`LIMIT (\d+)`)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.FormValue("q")
+		w.Header().Set("Content-Type", "application/json")
+
+		var values [][]interface{}
+		if m := sensorTag.FindStringSubmatch(q); m != nil {
+			n := len(readings[m[1]])
+			if l := limit.FindStringSubmatch(q); l != nil {
+				fmt.Sscan(l[1], &n)
+			}
+			for i, rd := range readings[m[1]] {
+				if i == n {
+					break
+				}
+				values = append(values, []interface{}{rd.DateTime, rd.Value})
+			}
+		}
+		if values == nil {
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": []interface{}{map[string]interface{}{
+				"statement_id": 0,
+				"series": []interface{}{map[string]interface{}{
+					"name":    "readings",
+					"columns": []string{"time", "value"},
+					"values":  values,
+				}},
+			}},
+		})
+	}))
+}
+
+func TestDeviceReadings(t *testing.T) {
+
+	influx := fakeInflux(map[string][]reading{
+		"device:testsen1:sensorid:1": {
+			{DateTime: "2018-03-01T10:15:00Z", Value: 1.3},
+			{DateTime: "2018-03-01T10:00:00Z", Value: 1.2},
+		},
+		"device:testsen1:sensorid:2": {
+			{DateTime: "2018-03-01T10:00:00Z", Value: 7.5},
+		},
+	})
+	defer influx.Close()
+
+	config, store := newMemoryTestConfig()
+	store.addDevice(device{ID: "device:quiet", Owner: "kentnetwork"})
+	store.addSensor(sensor{ID: "device:quiet:sensorid:1", ParentDevice: "device:quiet", SensorType: "riverLevel", Unit: "m"})
+	config.readings = nil
+	config.Influx = influxConfig{Host: influx.URL, Db: "kentnetwork"}
+	config, _ = config.influxDBClient()
+	router := setupRouter(config)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("Subject: Readings of a device from InfluxDB", t, func() {
+
+		Convey("When a device with readings is requested", func() {
+			w := get("/devices/device:testsen1/readings")
+			var body struct {
+				Items []sensorReadingGroup `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+
+			Convey("Then its readings are found rather than a 404", func() {
+				So(w.Code, ShouldEqual, 200)
+			})
+
+			Convey("Then the readings are grouped under each sensor", func() {
+				So(body.Items, ShouldHaveLength, 2)
+				So(body.Items[0].Sensor.ID, ShouldEqual, "device:testsen1:sensorid:1")
+				So(body.Items[0].Sensor.SensorType, ShouldEqual, "riverLevel")
+				So(body.Items[0].Readings, ShouldHaveLength, 2)
+				So(body.Items[0].Readings[0].DateTime, ShouldEqual, "2018-03-01T10:15:00Z")
+				So(body.Items[1].Sensor.Unit, ShouldEqual, "C")
+				So(body.Items[1].Readings[0].Value, ShouldEqual, 7.5)
+			})
+		})
+
+		Convey("When the flat format is requested", func() {
+			w := get("/devices/device:testsen1/readings?format=flat")
+			var body struct {
+				Items []reading `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+
+			Convey("Then every reading is listed in sensor order", func() {
+				So(w.Code, ShouldEqual, 200)
+				So(body.Items, ShouldHaveLength, 3)
+				So(body.Items[0].Sensor, ShouldEqual, "device:testsen1:sensorid:1")
+				So(body.Items[2].Sensor, ShouldEqual, "device:testsen1:sensorid:2")
+			})
+		})
+
+		Convey("When a page ends part way through a sensor", func() {
+			w := get("/devices/device:testsen1/readings?limit=1")
+			var body struct {
+				Meta  meta                 `json:"meta"`
+				Items []sensorReadingGroup `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+
+			Convey("Then only that sensor is on the page", func() {
+				So(body.Items, ShouldHaveLength, 1)
+				So(body.Items[0].Readings, ShouldHaveLength, 1)
+				So(body.Meta.NextCursor, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("When a device has sensors but no readings", func() {
+			So(get("/devices/device:quiet/readings").Code, ShouldEqual, 404)
+		})
+
+		Convey("When an unknown format is requested", func() {
+			So(get("/devices/device:testsen1/readings?format=csv").Code, ShouldEqual, 400)
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeviceStatusEvents(t *testing.T) {
+
+	Convey("Subject: Device status events", t, func() {
+		config, store := newMemoryTestConfig()
+		router := setupRouter(config)
+
+		post := func(deviceID, body string) int {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/devices/"+deviceID+"/status", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+		history := func(deviceID string) (int, []status) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices/"+deviceID+"/status", nil)
+			router.ServeHTTP(w, req)
+			var body struct {
+				Items []status `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			return w.Code, body.Items
+		}
+
+		Convey("When a device that has never reported is activated", func() {
+			So(post("device:testsen1", `{"type":"Active","reason":"Installed"}`), ShouldEqual, 201)
+
+			Convey("Then the device document carries the current status", func() {
+				d, err := config.metadataStore().Device(context.Background(), "device:testsen1")
+				So(err, ShouldBeNil)
+				So(d.Status, ShouldNotBeNil)
+				So(d.Status.Type, ShouldEqual, Active)
+				So(d.Status.DateTime, ShouldNotBeEmpty)
+			})
+
+			Convey("Then the history lists events newest first", func() {
+				So(post("device:testsen1", `{"type":4,"reason":"Sensor blocked"}`), ShouldEqual, 201)
+				code, events := history("device:testsen1")
+				So(code, ShouldEqual, 200)
+				So(len(events), ShouldEqual, 2)
+				So(events[0].Type, ShouldEqual, Fault)
+				So(events[1].Reason, ShouldEqual, "Installed")
+			})
+		})
+
+		Convey("When a device is decommissioned through its status", func() {
+			So(post("device:testsen1", `{"type":"Decommisioned"}`), ShouldEqual, 400)
+			Convey("Then it keeps its status so DELETE can still deregister it", func() {
+				_, events := history("device:testsen1")
+				So(events, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a decommissioned device is reactivated", func() {
+			store.AddStatusEvent(context.Background(), "device:testsen1", status{Type: Decommisioned})
+			Convey("Then the transition is rejected", func() {
+				So(post("device:testsen1", `{"type":"Active"}`), ShouldEqual, 409)
+				_, events := history("device:testsen1")
+				So(len(events), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When an active device is marked unseen", func() {
+			So(post("device:testsen1", `{"type":"Active"}`), ShouldEqual, 201)
+			So(post("device:testsen1", `{"type":"Unseen"}`), ShouldEqual, 409)
+		})
+
+		Convey("When the body or device is invalid", func() {
+			So(post("device:testsen1", `{"type":"Lost"}`), ShouldEqual, 400)
+			So(post("device:testsen1", `{"type":9}`), ShouldEqual, 400)
+			So(post("device:testsen1", `{}`), ShouldEqual, 400)
+			So(post("badrobot", `{"type":"Active"}`), ShouldEqual, 404)
+			code, _ := history("badrobot")
+			So(code, ShouldEqual, 404)
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes, one for each status the API answers errors with
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusNotImplemented:      "not_implemented",
+	http.StatusBadGateway:          "bad_gateway",
+	http.StatusServiceUnavailable:  "service_unavailable",
+	http.StatusGatewayTimeout:      "gateway_timeout",
+}
+
+// apiError - The body of every error response, wrapped as {"error": ...}
+type apiError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	RequestID string      `json:"requestId"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// respondError aborts the request with an error envelope
+func respondError(c *gin.Context, status int, message string) {
+	respondErrorDetails(c, status, message, nil)
+}
+
+// respondErrorDetails aborts the request with an error envelope carrying
+// details, such as the parameter that was rejected
+func respondErrorDetails(c *gin.Context, status int, message string, details interface{}) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	c.AbortWithStatusJSON(status, errorResponse{apiError{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFrom(c),
+		Details:   details,
+	}})
+}
+
+// respondParamError answers a query parameter or body that could not be used
+func respondParamError(c *gin.Context, message string, err error) {
+	respondErrorDetails(c, http.StatusBadRequest, message, gin.H{"reason": err.Error()})
+}
+
+// respondBackendError answers a failed CouchDB, InfluxDB or TTN call
+func respondBackendError(c *gin.Context, message string, err error) {
+	respondError(c, backendStatus(err), message)
+}
+
+// backendStatus picks the status for a failed backend call: 504 when it timed
+// out, 503 when the backend could not be reached and 502 when it answered badly
+func backendStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// recoverErrors - Middleware answering a panicking handler with a 500 envelope
+// rather than an empty body
+func recoverErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				requestLog(c).With(logFields{"panic": fmt.Sprint(r)}).Error("handler panicked")
+				respondError(c, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
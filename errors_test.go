@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// errorMessage returns the message of an error envelope
+func errorMessage(body []byte) string {
+	var resp errorResponse
+	json.Unmarshal(body, &resp)
+	return resp.Error.Message
+}
+
+// timeoutError - A net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorEnvelope(t *testing.T) {
+
+	config, _ := newMemoryTestConfig()
+	router := setupRouter(config)
+
+	request := func(router http.Handler, method, path string) (*httptest.ResponseRecorder, errorResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set(requestIDHeader, "trace-789")
+		router.ServeHTTP(w, req)
+		var resp errorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	Convey("Subject: JSON error envelope", t, func() {
+
+		Convey("When a device is not found", func() {
+			w, resp := request(router, "GET", "/devices/badrobot")
+			So(w.Code, ShouldEqual, 404)
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "application/json")
+			So(resp.Error.Code, ShouldEqual, "not_found")
+			So(resp.Error.Message, ShouldEqual, "Device not found")
+			So(resp.Error.RequestID, ShouldEqual, "trace-789")
+		})
+
+		Convey("When a parameter is rejected the reason is given in details", func() {
+			w, resp := request(router, "GET", "/devices?limit=0")
+			So(w.Code, ShouldEqual, 400)
+			So(resp.Error.Code, ShouldEqual, "bad_request")
+			So(resp.Error.Details, ShouldContainKey, "reason")
+		})
+
+		Convey("When a body cannot be parsed", func() {
+			w, resp := request(router, "POST", "/sensors")
+			So(w.Code, ShouldEqual, 400)
+			So(resp.Error.Message, ShouldEqual, "Failed to parse body")
+		})
+
+		Convey("When a route does not exist", func() {
+			w, resp := request(router, "GET", "/robots")
+			So(w.Code, ShouldEqual, 404)
+			So(resp.Error.Message, ShouldEqual, "Route not found")
+
+			w, resp = request(router, "PUT", "/sensors")
+			So(w.Code, ShouldEqual, 405)
+			So(resp.Error.Code, ShouldEqual, "method_not_allowed")
+		})
+
+		Convey("When a handler panics", func() {
+			r := setupRouter(config)
+			r.GET("/panic", func(c *gin.Context) { panic("boom") })
+			w, resp := request(r, "GET", "/panic")
+			So(w.Code, ShouldEqual, 500)
+			So(resp.Error.Code, ShouldEqual, "internal_error")
+			So(resp.Error.RequestID, ShouldEqual, "trace-789")
+		})
+
+		Convey("When a backend fails", func() {
+			Convey("Then a timeout is a 504", func() {
+				So(backendStatus(context.DeadlineExceeded), ShouldEqual, 504)
+				So(backendStatus(fmt.Errorf("query: %w", timeoutError{})), ShouldEqual, 504)
+			})
+
+			Convey("Then an unreachable backend is a 503", func() {
+				listener, _ := net.Listen("tcp", "127.0.0.1:0")
+				addr := listener.Addr().String()
+				listener.Close()
+				_, err := http.Get("http://" + addr)
+				So(backendStatus(err), ShouldEqual, 503)
+				So(backendStatus(registryError{err}), ShouldEqual, 503)
+			})
+
+			Convey("Then a bad answer is a 502", func() {
+				So(backendStatus(errors.New("couchdb: unexpected status 500")), ShouldEqual, 502)
+			})
+
+			Convey("Then CouchDB being down is a 503 envelope", func() {
+				listener, _ := net.Listen("tcp", "127.0.0.1:0")
+				addr := listener.Addr().String()
+				listener.Close()
+				w, resp := request(setupRouter(runtimeConfig{Couch: couchConfig{Host: "http://" + addr}}), "GET", "/devices/device:testsen1")
+				So(w.Code, ShouldEqual, 503)
+				So(resp.Error.Message, ShouldEqual, "Couchdb connection error")
+			})
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	earthRadiusKm  = 6371.0088
+	maxLocRadiusKm = 500
+)
+
+// deviceFilter - Criteria for GET /devices, every non-empty criterion must match
+type deviceFilter struct {
+	CatchmentName  string
+	AssociatedWith string
+	Town           string
+	Status         eventType  // 0 matches any status
+	Near           *geoRadius // nil matches any location
+	Visible        visibility // Owners the caller may see, the zero value matches any owner
+}
+
+// sensorFilter - Criteria for listing sensors
+type sensorFilter struct {
+	ParentDevices map[string]bool // nil matches sensors of any device
+}
+
+// geoRadius - A circle on the earth's surface
+type geoRadius struct {
+	Lat      float64
+	Lon      float64
+	RadiusKm float64
+}
+
+// parseDeviceFilter reads the catchmentName, associatedWith, town, status and
+// loc-lat/loc-lon/loc-radius (km) query parameters
+func parseDeviceFilter(c *gin.Context) (f deviceFilter, err error) {
+	f.CatchmentName = c.Query("catchmentName")
+	f.AssociatedWith = c.Query("associatedWith")
+	f.Town = c.Query("town")
+
+	if c.Query("status") != "" {
+		if f.Status, err = parseEventType(c.Query("status")); err != nil {
+			return f, err
+		}
+	}
+
+	lat, lon, radius := c.Query("loc-lat"), c.Query("loc-lon"), c.Query("loc-radius")
+	if lat == "" && lon == "" && radius == "" {
+		return f, nil
+	}
+	if lat == "" || lon == "" || radius == "" {
+		return f, errors.New("loc-lat, loc-lon and loc-radius must be used together")
+	}
+
+	var near geoRadius
+	if near.Lat, err = strconv.ParseFloat(lat, 64); err != nil || math.Abs(near.Lat) > 90 {
+		return f, errors.New("invalid loc-lat")
+	}
+	if near.Lon, err = strconv.ParseFloat(lon, 64); err != nil || math.Abs(near.Lon) > 180 {
+		return f, errors.New("invalid loc-lon")
+	}
+	if near.RadiusKm, err = strconv.ParseFloat(radius, 64); err != nil || near.RadiusKm <= 0 || near.RadiusKm > maxLocRadiusKm {
+		return f, errors.New("invalid loc-radius")
+	}
+	f.Near = &near
+	return f, nil
+}
+
+// isZero reports whether the filter lets every device through
+func (f deviceFilter) isZero() bool {
+	return f == deviceFilter{}
+}
+
+// match reports whether a device satisfies every criterion of the filter
+func (f deviceFilter) match(d device) bool {
+	if !f.Visible.canSee(d.Owner, d.Public) {
+		return false
+	}
+	if f.Status != 0 {
+		current := Unseen
+		if d.Status != nil {
+			current = d.Status.Type
+		}
+		if current != f.Status {
+			return false
+		}
+	}
+
+	if f.CatchmentName == "" && f.AssociatedWith == "" && f.Town == "" && f.Near == nil {
+		return true
+	}
+	if d.Location == nil {
+		return false
+	}
+	if f.CatchmentName != "" && !strings.EqualFold(d.Location.CatchmentName, f.CatchmentName) {
+		return false
+	}
+	if f.AssociatedWith != "" && !strings.EqualFold(d.Location.AssociatedWith, f.AssociatedWith) {
+		return false
+	}
+	if f.Town != "" && !strings.EqualFold(d.Location.NearestTown, f.Town) {
+		return false
+	}
+	if f.Near != nil && haversineKm(f.Near.Lat, f.Near.Lon, float64(d.Location.Lat), float64(d.Location.Lon)) > f.Near.RadiusKm {
+		return false
+	}
+	return true
+}
+
+// isZero reports whether the filter lets every sensor through
+func (f sensorFilter) isZero() bool {
+	return f.ParentDevices == nil
+}
+
+// match reports whether a sensor satisfies the filter
+func (f sensorFilter) match(s sensor) bool {
+	return f.ParentDevices == nil || f.ParentDevices[s.ParentDevice]
+}
+
+// haversineKm returns the great-circle distance between two points in kilometres
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeviceFilter(t *testing.T) {
+	config, store := newMemoryTestConfig()
+	store.addDevice(device{ID: "device:rochester", Status: &status{Type: Active},
+		Location: &location{NearestTown: "Rochester", CatchmentName: "Medway", Lat: 51.3882, Lon: 0.5046}})
+	store.addDevice(device{ID: "device:tonbridge", Status: &status{Type: Active},
+		Location: &location{NearestTown: "Tonbridge", CatchmentName: "Medway", Lat: 51.1950, Lon: 0.2750}})
+	store.addDevice(device{ID: "device:canterbury", Status: &status{Type: Active},
+		Location: &location{NearestTown: "Canterbury", CatchmentName: "Stour", Lat: 51.2802, Lon: 1.0789}})
+	store.addDevice(device{ID: "device:aylesford", Status: &status{Type: Fault},
+		Location: &location{NearestTown: "Aylesford", CatchmentName: "Medway", Lat: 51.3030, Lon: 0.4790}})
+	router := setupRouter(config)
+
+	devices := func(query string) (code int, ids []string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/devices?"+query, nil)
+		router.ServeHTTP(w, req)
+		var body struct {
+			Items []device `json:"items"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		for _, d := range body.Items {
+			ids = append(ids, d.ID)
+		}
+		return w.Code, ids
+	}
+
+	Convey("Subject: Filtering GET /devices", t, func() {
+
+		Convey("When the haversine distance between Maidstone and Rochester is computed", func() {
+			So(haversineKm(51.2704, 0.5227, 51.3882, 0.5046), ShouldAlmostEqual, 13.16, 0.05)
+		})
+
+		Convey("When active Medway devices within 5km of Maidstone are requested", func() {
+			code, ids := devices("status=active&catchmentName=medway&loc-lat=51.2704&loc-lon=0.5227&loc-radius=5")
+			Convey("Then only devices matching every filter are returned", func() {
+				So(code, ShouldEqual, 200)
+				So(ids, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the radius is widened to 15km", func() {
+			_, ids := devices("status=Active&catchmentName=Medway&loc-lat=51.2704&loc-lon=0.5227&loc-radius=15")
+			So(ids, ShouldResemble, []string{"device:rochester"})
+		})
+
+		Convey("When filtering by town", func() {
+			_, ids := devices("town=Canterbury")
+			So(ids, ShouldResemble, []string{"device:canterbury"})
+		})
+
+		Convey("When filtering by a status no device has reported", func() {
+			_, ids := devices("status=Unseen")
+			Convey("Then devices without status events count as unseen", func() {
+				So(ids, ShouldResemble, []string{"device:testsen1"})
+			})
+		})
+
+		Convey("When filtered results are paged", func() {
+			_, first := devices("catchmentName=Medway&limit=2")
+			So(len(first), ShouldEqual, 2)
+		})
+
+		Convey("When the location filter is incomplete or invalid", func() {
+			for _, query := range []string{"loc-lat=51.27&loc-lon=0.52", "loc-lat=91&loc-lon=0&loc-radius=5", "loc-lat=51&loc-lon=0&loc-radius=-1", "status=Lost"} {
+				code, _ := devices(query)
+				So(code, ShouldEqual, 400)
+			}
+		})
+	})
+}
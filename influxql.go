@@ -0,0 +1,173 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxQuery - Builder for InfluxQL SELECT statements. Identifiers and literals
+// are always escaped so user supplied values can never change the statement.
+type influxQuery struct {
+	fields     []string
+	from       string
+	conditions []string
+	groupBy    []string
+	fill       string
+	orderDesc  bool
+	limit      int
+}
+
+var (
+	numericFill   = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	identEscaper  = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`)
+	regexEscaper  = strings.NewReplacer(`/`, `\/`)
+)
+
+// quoteIdent quotes a measurement, tag or field name
+func quoteIdent(name string) string {
+	return `"` + identEscaper.Replace(name) + `"`
+}
+
+// quoteString quotes a string literal
+func quoteString(value string) string {
+	return `'` + stringEscaper.Replace(value) + `'`
+}
+
+// quoteTime formats a timestamp as an RFC3339 string literal
+func quoteTime(t time.Time) string {
+	return quoteString(t.UTC().Format(time.RFC3339Nano))
+}
+
+// influxField builds a field expression such as last("value") AS "value".
+// fn and alias are optional; fn must come from code, never from a request.
+func influxField(fn string, name string, alias string) string {
+	expr := quoteIdent(name)
+	if fn != "" {
+		expr = fn + "(" + expr + ")"
+	}
+	if alias != "" {
+		expr += " AS " + quoteIdent(alias)
+	}
+	return expr
+}
+
+func newInfluxQuery(fields ...string) *influxQuery {
+	return &influxQuery{fields: fields}
+}
+
+// From selects a single measurement
+func (q *influxQuery) From(measurement string) *influxQuery {
+	q.from = quoteIdent(measurement)
+	return q
+}
+
+// FromRegex selects every measurement matching a regular expression
+func (q *influxQuery) FromRegex(pattern string) *influxQuery {
+	q.from = "/" + regexEscaper.Replace(pattern) + "/"
+	return q
+}
+
+// WhereTag restricts the results to a tag value
+func (q *influxQuery) WhereTag(tag string, value string) *influxQuery {
+	q.conditions = append(q.conditions, quoteIdent(tag)+" = "+quoteString(value))
+	return q
+}
+
+// WhereTime restricts the results with a time comparison, op is one of < <= > >=
+func (q *influxQuery) WhereTime(op string, t time.Time) *influxQuery {
+	switch op {
+	case "<", "<=", ">", ">=":
+	default:
+		panic("influxql: invalid time operator " + op)
+	}
+	q.conditions = append(q.conditions, "time "+op+" "+quoteTime(t))
+	return q
+}
+
+// GroupBy adds a GROUP BY clause on tags
+func (q *influxQuery) GroupBy(tags ...string) *influxQuery {
+	for _, tag := range tags {
+		q.groupBy = append(q.groupBy, quoteIdent(tag))
+	}
+	return q
+}
+
+// GroupByTime buckets points into fixed intervals, it must be combined with a time range
+func (q *influxQuery) GroupByTime(interval time.Duration) *influxQuery {
+	q.groupBy = append([]string{"time(" + durationLiteral(interval) + ")"}, q.groupBy...)
+	return q
+}
+
+// Fill sets how empty GROUP BY time() buckets are reported, see validFill
+func (q *influxQuery) Fill(fill string) *influxQuery {
+	if !validFill(fill) {
+		panic("influxql: invalid fill " + fill)
+	}
+	q.fill = fill
+	return q
+}
+
+// OrderByTimeDesc returns the newest points first
+func (q *influxQuery) OrderByTimeDesc() *influxQuery {
+	q.orderDesc = true
+	return q
+}
+
+// Limit caps the number of points returned per series
+func (q *influxQuery) Limit(n int) *influxQuery {
+	q.limit = n
+	return q
+}
+
+func (q *influxQuery) String() string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	b.WriteString(strings.Join(q.fields, ", "))
+	b.WriteString(" FROM ")
+	b.WriteString(q.from)
+	if len(q.conditions) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(q.conditions, " AND "))
+	}
+	if len(q.groupBy) > 0 {
+		b.WriteString(" GROUP BY ")
+		b.WriteString(strings.Join(q.groupBy, ", "))
+	}
+	if q.fill != "" {
+		b.WriteString(" fill(" + q.fill + ")")
+	}
+	if q.orderDesc {
+		b.WriteString(" ORDER BY time DESC")
+	}
+	if q.limit > 0 {
+		b.WriteString(" LIMIT ")
+		b.WriteString(strconv.Itoa(q.limit))
+	}
+	return b.String()
+}
+
+// durationLiteral formats a duration as an InfluxQL duration literal such as 5m or 1d
+func durationLiteral(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	default:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+}
+
+// validFill reports whether fill is none, previous, linear or a number
+func validFill(fill string) bool {
+	switch fill {
+	case "none", "previous", "linear":
+		return true
+	}
+	return numericFill.MatchString(fill)
+}
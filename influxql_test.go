@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInfluxQueryEscaping(t *testing.T) {
+	Convey("Subject: InfluxQL query builder", t, func() {
+
+		Convey("When a plain sensor ID is queried", func() {
+			q := sensorReadingsQuery("device:testsen1:sensorid:2", readingQuery{})
+			Convey("Then the statement matches the original hand written query", func() {
+				So(q, ShouldEqual, `SELECT "value" FROM /.*/ WHERE "sensor_id" = 'device:testsen1:sensorid:2' ORDER BY time DESC LIMIT 100`)
+			})
+		})
+
+		Convey("When a date range is queried", func() {
+			start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+			end := time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC)
+			q := sensorReadingsQuery("s1", readingQuery{StartDate: start, EndDate: end})
+			Convey("Then the bounds are quoted RFC3339 literals", func() {
+				So(q, ShouldEqual, `SELECT "value" FROM /.*/ WHERE "sensor_id" = 's1' AND time >= '2018-03-01T00:00:00Z' AND time <= '2018-03-02T00:00:00Z' ORDER BY time DESC LIMIT 100`)
+			})
+		})
+
+		Convey("When a sensor ID tries to close the string literal", func() {
+			q := sensorReadingsQuery(`x') OR 1=1; DROP DATABASE kent --`, readingQuery{})
+			Convey("Then the quote is escaped and the payload stays inside the literal", func() {
+				So(q, ShouldEqual, `SELECT "value" FROM /.*/ WHERE "sensor_id" = 'x\') OR 1=1; DROP DATABASE kent --' ORDER BY time DESC LIMIT 100`)
+			})
+		})
+
+		Convey("When a sensor ID smuggles a backslash before the quote", func() {
+			q := sensorReadingsQuery(`x\' OR "sensor_id" =~ /.*/ --`, readingQuery{})
+			Convey("Then the backslash is escaped before the quote", func() {
+				So(q, ShouldEqual, `SELECT "value" FROM /.*/ WHERE "sensor_id" = 'x\\\' OR "sensor_id" =~ /.*/ --' ORDER BY time DESC LIMIT 100`)
+			})
+		})
+
+		Convey("When identifiers contain quotes", func() {
+			So(quoteIdent(`gateway"Mac`), ShouldEqual, `"gateway\"Mac"`)
+			So(quoteIdent(`a\`), ShouldEqual, `"a\\"`)
+		})
+
+		Convey("When a regex contains a slash", func() {
+			So(newInfluxQuery(`"value"`).FromRegex("a/b").String(), ShouldEqual, `SELECT "value" FROM /a\/b/`)
+		})
+
+		Convey("When gateway metadata is queried", func() {
+			var got string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.FormValue("q")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"results":[{}]}`))
+			}))
+			defer ts.Close()
+
+			config, err := runtimeConfig{Influx: influxConfig{Host: ts.URL}}.influxDBClient()
+			So(err, ShouldBeNil)
+			_, err = config.Influx.Gateways(context.Background())
+			Convey("Then the statement is built by the query builder", func() {
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, `SELECT last("lat") AS "lat", "lon" FROM "stat" GROUP BY "gatewayMac"`)
+			})
+		})
+	})
+}
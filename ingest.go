@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	maxReadingBatch = 5000            // Readings accepted by one request, InfluxDB's recommended batch size
+	maxClockSkew    = 5 * time.Minute // How far ahead of our clock a reading may be dated
+	sourceAPI       = "api"           // Tags readings submitted through the API
+)
+
+// readingWrite - A reading submitted by a data source outside TTN, such as a
+// manual gauge or third-party logger. The unit must be the sensor's own.
+type readingWrite struct {
+	Sensor   string   `json:"sensor"`
+	DateTime string   `json:"dateTime"` // Defaults to the time it was received
+	Value    *float64 `json:"value"`
+	Unit     string   `json:"unit"`
+}
+
+// readingError - Why a submitted reading was refused, Index is its position in the request
+type readingError struct {
+	Index  int
+	Sensor string
+	Err    error
+}
+
+func (e readingError) Error() string {
+	return fmt.Sprintf("readings[%d]: %s", e.Index, e.Err)
+}
+
+func (e readingError) Unwrap() error {
+	return e.Err
+}
+
+// checkReadings validates every submitted reading against its sensor, so a
+// request is stored whole or not at all. Readings may only be written to the
+// sensors of devices the caller may manage.
+func checkReadings(ctx context.Context, store MetadataStore, v visibility, writes []readingWrite, now time.Time) ([]readingPoint, error) {
+	sensors := map[string]sensor{}
+	points := make([]readingPoint, len(writes))
+	for i, w := range writes {
+		if w.Sensor == "" {
+			return nil, readingError{i, w.Sensor, errors.New("sensor is required")}
+		}
+		s, ok := sensors[w.Sensor]
+		if !ok {
+			var err error
+			s, err = manageableSensor(ctx, store, v, w.Sensor)
+			if err == errNotFound || err == errForbidden {
+				return nil, readingError{i, w.Sensor, err}
+			}
+			if err != nil {
+				return nil, err
+			}
+			sensors[w.Sensor] = s
+		}
+
+		r, err := validReading(w, s, now)
+		if err != nil {
+			return nil, readingError{i, w.Sensor, err}
+		}
+		points[i] = readingPoint{reading: r, SensorType: s.SensorType, Unit: s.Unit, Source: sourceAPI}
+	}
+	return points, nil
+}
+
+// validReading checks a submitted reading and returns it as it will be stored
+func validReading(w readingWrite, s sensor, now time.Time) (reading, error) {
+	if w.Value == nil {
+		return reading{}, errors.New("value is required")
+	}
+	if w.Unit == "" {
+		return reading{}, errors.New("unit is required")
+	}
+	if w.Unit != s.Unit {
+		return reading{}, fmt.Errorf("unit %q does not match the sensor's unit %q", w.Unit, s.Unit)
+	}
+
+	t := now
+	if w.DateTime != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, w.DateTime); err != nil {
+			return reading{}, errors.New("dateTime must be an RFC3339 date-time")
+		}
+		if t.After(now.Add(maxClockSkew)) {
+			return reading{}, errors.New("dateTime is in the future")
+		}
+	}
+	return reading{Sensor: s.ID, DateTime: t.UTC().Format(dateTimeLayout), Value: *w.Value}, nil
+}
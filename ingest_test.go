@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadingIngestion(t *testing.T) {
+
+	Convey("Subject: Storing readings from sources outside TTN", t, func() {
+		config, store := newMemoryTestConfig()
+		router := setupRouter(config)
+
+		send := func(method, path, body string) (*httptest.ResponseRecorder, errorResponse) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			var resp errorResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w, resp
+		}
+
+		Convey("When a manual gauge reading is posted to a sensor", func() {
+			w, _ := send("POST", "/sensors/device:testsen1:sensorid:1/readings", `[{"dateTime":"2018-03-02T09:00:00+01:00","value":1.6,"unit":"m"}]`)
+
+			Convey("Then it is stored in UTC and returned", func() {
+				So(w.Code, ShouldEqual, 201)
+				So(w.Body.String(), ShouldContainSubstring, `"dateTime":"2018-03-02T08:00:00Z"`)
+				latest, _ := store.SensorReadings(context.Background(), "device:testsen1:sensorid:1", readingQuery{Latest: true, Limit: 1})
+				So(latest, ShouldResemble, []reading{{Sensor: "device:testsen1:sensorid:1", DateTime: "2018-03-02T08:00:00Z", Value: 1.6}})
+			})
+		})
+
+		Convey("When a reading has no time", func() {
+			before := time.Now().Add(-time.Second)
+			w, _ := send("POST", "/sensors/device:testsen1:sensorid:2/readings", `[{"value":8,"unit":"C"}]`)
+			So(w.Code, ShouldEqual, 201)
+			latest, _ := store.SensorReadings(context.Background(), "device:testsen1:sensorid:2", readingQuery{Latest: true, Limit: 1})
+			So(readingTime(latest[0]), ShouldHappenAfter, before)
+		})
+
+		Convey("When a logger posts a batch for several sensors", func() {
+			w, _ := send("POST", "/data/readings", `[
+				{"sensor":"device:testsen1:sensorid:1","dateTime":"2018-03-03T10:00:00Z","value":1.1,"unit":"m"},
+				{"sensor":"device:testsen1:sensorid:2","dateTime":"2018-03-03T10:00:00Z","value":6.5,"unit":"C"}
+			]`)
+			So(w.Code, ShouldEqual, 201)
+			So(len(store.readings["device:testsen1:sensorid:1"]), ShouldEqual, 3)
+			So(len(store.readings["device:testsen1:sensorid:2"]), ShouldEqual, 2)
+		})
+
+		Convey("When one reading of a batch is invalid", func() {
+			w, resp := send("POST", "/data/readings", `[
+				{"sensor":"device:testsen1:sensorid:1","value":1.1,"unit":"m"},
+				{"sensor":"device:testsen1:sensorid:2","value":6.5,"unit":"F"}
+			]`)
+
+			Convey("Then nothing is stored and the reading is identified", func() {
+				So(w.Code, ShouldEqual, 400)
+				So(resp.Error.Message, ShouldContainSubstring, "readings[1]")
+				So(resp.Error.Message, ShouldContainSubstring, "does not match the sensor's unit")
+				So(resp.Error.Details, ShouldContainKey, "index")
+				So(len(store.readings["device:testsen1:sensorid:1"]), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When readings are refused", func() {
+			w, _ := send("POST", "/data/readings", `[{"sensor":"badrobot","value":1,"unit":"m"}]`)
+			So(w.Code, ShouldEqual, 404)
+			w, _ = send("POST", "/data/readings", `[{"value":1,"unit":"m"}]`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("POST", "/data/readings", `[]`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("POST", "/sensors/device:testsen1:sensorid:1/readings", `[{"unit":"m"}]`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("POST", "/sensors/device:testsen1:sensorid:1/readings", `[{"value":1,"unit":"m","dateTime":"tomorrow"}]`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("POST", "/sensors/device:testsen1:sensorid:1/readings", `[{"value":1,"unit":"m","dateTime":"`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}]`)
+			So(w.Code, ShouldEqual, 400)
+			w, _ = send("POST", "/sensors/device:testsen1:sensorid:1/readings", `[{"sensor":"device:testsen1:sensorid:2","value":1,"unit":"C"}]`)
+			So(w.Code, ShouldEqual, 400)
+		})
+
+		Convey("When readings are written to InfluxDB", func() {
+			var db, lines string
+			influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				db = r.URL.Query().Get("db")
+				body, _ := ioutil.ReadAll(r.Body)
+				lines = string(body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer influx.Close()
+			config.readings = nil
+			config.Influx = influxConfig{Host: influx.URL, Db: "kentnetwork"}
+			config, _ = config.influxDBClient()
+			router = setupRouter(config)
+
+			w, _ := send("POST", "/data/readings", `[{"sensor":"device:testsen1:sensorid:1","dateTime":"2018-03-03T10:00:00Z","value":1.1,"unit":"m"}]`)
+
+			Convey("Then they are sent as one batch tagged with the sensor", func() {
+				So(w.Code, ShouldEqual, 201)
+				So(db, ShouldEqual, "kentnetwork")
+				So(lines, ShouldStartWith, "riverLevel,")
+				So(lines, ShouldContainSubstring, "sensor_id=device:testsen1:sensorid:1")
+				So(lines, ShouldContainSubstring, "source=api")
+			})
+		})
+	})
+}
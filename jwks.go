@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	auth0 "github.com/auth0-community/go-auth0"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	defaultJWKSRefresh = time.Hour
+	// minJWKSRefresh limits how often a token with an unknown kid can trigger a fetch
+	minJWKSRefresh = time.Minute
+)
+
+// jwksProvider - An auth0.SecretProvider that picks the verification key by the
+// token's kid from a JSON Web Key Set, fetched from the issuer or a local file
+type jwksProvider struct {
+	mu          sync.RWMutex
+	keys        map[string]jose.JSONWebKey
+	attemptedAt time.Time // Last fetch, whether or not it succeeded
+	fetch       func() (jose.JSONWebKeySet, error)
+	refreshing  sync.Mutex // Held while fetching, so only one fetch runs at a time
+}
+
+// newJWKSProvider loads the key set once so misconfiguration is found at start up
+func newJWKSProvider(c auth0Config) (*jwksProvider, error) {
+	p := &jwksProvider{keys: map[string]jose.JSONWebKey{}}
+	switch {
+	case c.JWKSFile != "":
+		p.fetch = jwksFromFile(c.JWKSFile)
+	case c.JWKSURL != "":
+		p.fetch = jwksFromURL(c.JWKSURL)
+	default:
+		return nil, errors.New("no JWKS URL or file configured")
+	}
+	return p, p.refresh()
+}
+
+func jwksFromFile(path string) func() (jose.JSONWebKeySet, error) {
+	return func() (set jose.JSONWebKeySet, err error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return set, err
+		}
+		err = json.Unmarshal(data, &set)
+		return set, err
+	}
+}
+
+// jwksFromURL fetches the key set from the issuer. A fetch is shared by every
+// request waiting on it, so it is bounded by its own timeout rather than a
+// request's context.
+func jwksFromURL(url string) func() (jose.JSONWebKeySet, error) {
+	return func() (set jose.JSONWebKeySet, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return set, err
+		}
+		resp, err := backendClient.Do(req)
+		if err != nil {
+			return set, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return set, fmt.Errorf("jwks: unexpected status %d from %s", resp.StatusCode, url)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&set)
+		return set, err
+	}
+}
+
+// refresh replaces the cached keys with the current key set. Keys that are
+// dropped from the set stop being accepted.
+func (p *jwksProvider) refresh() error {
+	p.refreshing.Lock()
+	defer p.refreshing.Unlock()
+	return p.load()
+}
+
+// refreshIfStale refreshes the key set unless a fetch was attempted within
+// minJWKSRefresh. Callers that wait on a running refresh share its result
+// rather than fetching again, and a failing issuer is retried no more often
+// than a working one.
+func (p *jwksProvider) refreshIfStale() error {
+	p.refreshing.Lock()
+	defer p.refreshing.Unlock()
+	p.mu.RLock()
+	stale := time.Since(p.attemptedAt) > minJWKSRefresh
+	p.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return p.load()
+}
+
+// load fetches the key set. The caller must hold refreshing.
+func (p *jwksProvider) load() error {
+	set, err := p.fetch()
+	p.mu.Lock()
+	p.attemptedAt = time.Now()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]jose.JSONWebKey{}
+	for _, k := range set.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			keys[k.KeyID] = k
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("jwks: key set has no signing keys")
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+// refreshEvery refreshes the key set in the background until stop is closed.
+// A failed refresh keeps the previous keys.
+func (p *jwksProvider) refreshEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.refresh(); err != nil {
+				logs.WithError(err).Warn("unable to refresh JWKS")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// key returns the key with the kid. An unknown kid triggers a refresh, as the
+// issuer may have rotated its keys since the last fetch.
+func (p *jwksProvider) key(kid string) (interface{}, error) {
+	p.mu.RLock()
+	k, ok := p.lookup(kid)
+	p.mu.RUnlock()
+	if ok {
+		return k.Key, nil
+	}
+
+	if err := p.refreshIfStale(); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	k, ok = p.lookup(kid)
+	p.mu.RUnlock()
+	if ok {
+		return k.Key, nil
+	}
+	return nil, fmt.Errorf("jwks: unknown key id %q", kid)
+}
+
+// lookup finds a key by kid, a token without a kid may only use a lone key.
+// The caller must hold mu.
+func (p *jwksProvider) lookup(kid string) (jose.JSONWebKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// GetSecret implements auth0.SecretProvider
+func (p *jwksProvider) GetSecret(r *http.Request) (interface{}, error) {
+	token, err := auth0.FromHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Headers) < 1 {
+		return nil, errors.New("jwks: token has no header")
+	}
+	return p.key(token.Headers[0].KeyID)
+}
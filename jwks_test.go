@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testKey - An RSA key pair published in a key set under kid
+type testKey struct {
+	kid     string
+	private *rsa.PrivateKey
+}
+
+func newTestKey(t *testing.T, kid string) testKey {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, private: private}
+}
+
+func (k testKey) public() jose.JSONWebKey {
+	return jose.JSONWebKey{Key: &k.private.PublicKey, KeyID: k.kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+// sign issues a token for issuer and audience signed with the key, naming its kid
+func (k testKey) sign(issuer, audience string) string {
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: k.private, KeyID: k.kid}}, nil)
+	raw, _ := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  "auth0|tester",
+		Issuer:   issuer,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Claims(map[string]interface{}{"groups": []string{groupRead}}).CompactSerialize()
+	return raw
+}
+
+func keySet(keys ...testKey) []byte {
+	set := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.public())
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func TestJWKS(t *testing.T) {
+	defer func() { validator, groupsClaim = nil, defaultGroupsClaim }()
+	first, second := newTestKey(t, "first"), newTestKey(t, "second")
+
+	Convey("Subject: Validating tokens against a JSON Web Key Set", t, func() {
+
+		Convey("When the key set is read from a local file", func() {
+			dir, _ := ioutil.TempDir("", "jwks")
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "jwks.json")
+			So(ioutil.WriteFile(path, keySet(first), 0600), ShouldBeNil)
+
+			config, _ := newMemoryTestConfig()
+			config.Auth0 = auth0Config{JWKSFile: path, Issuer: "https://issuer.test/", Audience: "test-api"}
+			setupAuth0(config)
+			router := setupRouter(config)
+
+			request := func(token string) int {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/devices", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				router.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			Convey("Then tokens from the configured issuer and audience are accepted", func() {
+				So(request(first.sign("https://issuer.test/", "test-api")), ShouldEqual, 200)
+			})
+
+			Convey("Then tokens for another issuer, audience or key are refused", func() {
+				So(request(first.sign("https://kentnetworkuk.eu.auth0.com/", "test-api")), ShouldEqual, 401)
+				So(request(first.sign("https://issuer.test/", "kentnetwork")), ShouldEqual, 401)
+				So(request(second.sign("https://issuer.test/", "test-api")), ShouldEqual, 401)
+			})
+		})
+
+		Convey("When the issuer rotates its keys", func() {
+			var mu sync.Mutex
+			published := keySet(first)
+			fetches := 0
+			issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				fetches++
+				w.Write(published)
+			}))
+			defer issuer.Close()
+
+			p, err := newJWKSProvider(auth0Config{JWKSURL: issuer.URL})
+			So(err, ShouldBeNil)
+			_, err = p.key("first")
+			So(err, ShouldBeNil)
+
+			mu.Lock()
+			published = keySet(second)
+			mu.Unlock()
+
+			Convey("Then an unknown kid is not fetched again within a minute", func() {
+				_, err := p.key("second")
+				So(err, ShouldNotBeNil)
+				So(fetches, ShouldEqual, 1)
+			})
+
+			Convey("Then an unknown kid refreshes a stale key set", func() {
+				p.attemptedAt = time.Now().Add(-2 * minJWKSRefresh)
+				_, err := p.key("second")
+				So(err, ShouldBeNil)
+				So(fetches, ShouldEqual, 2)
+
+				Convey("And the retired key is no longer accepted", func() {
+					_, err := p.key("first")
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("Then a failing issuer is fetched once however many tokens arrive", func() {
+				mu.Lock()
+				published = []byte("upstream error")
+				mu.Unlock()
+				p.attemptedAt = time.Now().Add(-2 * minJWKSRefresh)
+
+				var wg sync.WaitGroup
+				for i := 0; i < 20; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						p.key("second")
+					}()
+				}
+				wg.Wait()
+				_, err := p.key("second")
+				So(err, ShouldNotBeNil)
+				So(fetches, ShouldEqual, 2)
+
+				Convey("And the keys it already had keep working", func() {
+					_, err := p.key("first")
+					So(err, ShouldBeNil)
+				})
+			})
+
+			Convey("Then the background refresh picks up the new keys", func() {
+				stop := make(chan struct{})
+				go p.refreshEvery(10*time.Millisecond, stop)
+				defer close(stop)
+				So(func() bool {
+					for i := 0; i < 100; i++ {
+						p.mu.RLock()
+						_, ok := p.keys["second"]
+						p.mu.RUnlock()
+						if ok {
+							return true
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+					return false
+				}(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the key set cannot be loaded", func() {
+			_, err := newJWKSProvider(auth0Config{JWKSFile: "/nonexistent/jwks.json"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
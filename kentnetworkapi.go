@@ -1,29 +1,19 @@
 package main
 
 import (
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
 	"flag"
-	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 
-	auth0 "github.com/auth0-community/go-auth0"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	client "github.com/influxdata/influxdb/client/v2"
-	jose "gopkg.in/square/go-jose.v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	resultLimit = 100
 )
 
-var validator *auth0.JWTValidator
-
 var events = [...]string{
 	"Unseen",
 	"Active",
@@ -43,30 +33,24 @@ func main() {
 		config = importYmlConf(runtimeFlags.configFile)
 	}
 
-	configErr := validConfig(config)
-	if configErr != nil {
-		panic(configErr)
-	}
-
-	if config.Auth0.Key != "" {
+	if config.Auth0.enabled() {
 		setupAuth0(config)
 	}
 
-	var err error
-	config, err = config.influxDBClient()
+	r := setupRouter(config)
 
-	if err != nil {
-		log.Fatal(err)
+	if config.TTN.MQTT {
+		if err := subscribeUplinks(config); err != nil {
+			logs.WithError(err).Error("could not subscribe to TTN uplinks")
+		}
 	}
 
-	r := setupRouter(config)
-
 	// CORS -- update
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"PUT", "PATCH", "DELETE", "GET", "POST"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", requestIDHeader},
+		ExposeHeaders:    []string{"Content-Length", requestIDHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -78,106 +62,63 @@ func main() {
 func setupRouter(config runtimeConfig) *gin.Engine {
 	// Disable Console Color
 	// gin.DisableConsoleColor()
-	r := gin.Default()
+	r := gin.New()
+	r.Use(requestID(), accessLog(), recoverErrors(), requestMetrics())
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(func(c *gin.Context) { respondError(c, http.StatusNotFound, "Route not found") })
+	r.NoMethod(func(c *gin.Context) { respondError(c, http.StatusMethodNotAllowed, "Method not allowed") })
 
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	r.GET("/status", GET_status(config))
-
-	// If an auth0 key is defined use this for endpoints
-	if config.Auth0.Key != "" {
-		r.GET("/devices", Auth0Groups(), GET_devices(config))
-		r.PUT("/devices", Auth0Groups(), PUT_devices(config))
-		r.GET("/devices/:deviceId", Auth0Groups(), GET_devices_id(config))
-		r.GET("/devices/:deviceId/sensors", Auth0Groups(), GET_devices_id_sensors(config))
-		r.GET("/devices/:deviceId/readings", Auth0Groups(), GET_device_id_readings(config))
-		r.GET("/sensors", Auth0Groups(), GET_sensors(config))
-		r.GET("/sensors/:sensorId", Auth0Groups(), GET_sensors_id(config))
-		r.GET("/sensors/:sensorId/readings", Auth0Groups(), GET_sensors_id_readings(config))
-		r.GET("/data/readings", Auth0Groups(), GET_data_readings(config))
-		r.GET("/gateways", Auth0Groups(), GET_gateways(config))
-	} else {
-		r.GET("/devices", GET_devices(config))
-		r.PUT("/devices", PUT_devices(config))
-		r.GET("/devices/:deviceId", GET_devices_id(config))
-		r.GET("/devices/:deviceId/sensors", GET_devices_id_sensors(config))
-		r.GET("/devices/:deviceId/readings", GET_device_id_readings(config))
-		r.GET("/sensors", GET_sensors(config))
-		r.GET("/sensors/:sensorId", GET_sensors_id(config))
-		r.GET("/sensors/:sensorId/readings", GET_sensors_id_readings(config))
-		r.GET("/data/readings", GET_data_readings(config))
-		r.GET("/gateways", GET_gateways(config))
+	r.GET("/healthz", GET_healthz(config))
+	r.GET("/readyz", GET_readyz(config))
+	r.POST("/login", POST_login(config))
+	r.POST("/ttn/uplink", POST_ttn_uplink(config))
+
+	// If auth0 is configured the endpoints require a token or API key carrying one of their groups
+	readers := r.Group("/")
+	admins := r.Group("/")
+	operators := r.Group("/")
+	if config.Auth0.enabled() {
+		keys := newAPIKeyAuth(config.metadataStore())
+		readers.Use(keys.Groups(groupRead, groupDeviceAdmin, groupAdmin))
+		admins.Use(keys.Groups(groupDeviceAdmin, groupAdmin))
+		operators.Use(keys.Groups(groupAdmin))
 	}
 
-	return r
-}
-
-// LoadPublicKey loads a public key from PEM/DER-encoded data for jwt verifying
-func LoadPublicKey(data []byte) (interface{}, error) {
-	input := data
-
-	block, _ := pem.Decode(data)
-	if block != nil {
-		input = block.Bytes
-	}
-
-	// Try to load SubjectPublicKeyInfo
-	pub, err0 := x509.ParsePKIXPublicKey(input)
-	if err0 == nil {
-		return pub, nil
-	}
-
-	cert, err1 := x509.ParseCertificate(input)
-	if err1 == nil {
-		return cert.PublicKey, nil
-	}
-
-	return nil, fmt.Errorf("square/go-jose: parse error, got '%s' and '%s'", err0, err1)
-}
-
-func setupAuth0(config runtimeConfig) {
-	publicKeyLocation := config.Auth0.Key
-	//Creates a configuration with the Auth0 information
-	data, err := ioutil.ReadFile(publicKeyLocation)
-	if err != nil {
-		panic(fmt.Sprintf("Unable to read public key from disk (%s)", publicKeyLocation))
-	}
-
-	secret, err := LoadPublicKey(data)
-	if err != nil {
-		panic("Invalid public key")
-	}
-	secretProvider := auth0.NewKeyProvider(secret)
-	configuration := auth0.NewConfiguration(secretProvider, []string{"kentnetwork"}, "https://kentnetworkuk.eu.auth0.com/", jose.RS256)
-	validator = auth0.NewValidator(configuration, nil)
-}
+	readers.GET("/devices", GET_devices(config))
+	admins.PUT("/devices", PUT_devices(config))
+	admins.POST("/devices", POST_devices(config))
+	readers.GET("/devices/:deviceId", GET_devices_id(config))
+	admins.PATCH("/devices/:deviceId", PATCH_devices_id(config))
+	admins.DELETE("/devices/:deviceId", DELETE_devices_id(config))
+	readers.GET("/devices/:deviceId/sensors", GET_devices_id_sensors(config))
+	readers.GET("/devices/:deviceId/readings", GET_device_id_readings(config))
+	readers.GET("/devices/:deviceId/status", GET_devices_id_status(config))
+	admins.POST("/devices/:deviceId/status", POST_devices_id_status(config))
+	readers.GET("/sensors", GET_sensors(config))
+	admins.POST("/sensors", POST_sensors(config))
+	readers.GET("/sensors/:sensorId", GET_sensors_id(config))
+	admins.PATCH("/sensors/:sensorId", PATCH_sensors_id(config))
+	admins.DELETE("/sensors/:sensorId", DELETE_sensors_id(config))
+	readers.GET("/sensors/:sensorId/readings", GET_sensors_id_readings(config))
+	admins.POST("/sensors/:sensorId/readings", POST_sensors_id_readings(config))
+	readers.GET("/data/readings", GET_data_readings(config))
+	admins.POST("/data/readings", POST_data_readings(config))
+	readers.GET("/gateways", GET_gateways(config))
+	admins.GET("/apikeys", GET_apikeys(config))
+	admins.POST("/apikeys", POST_apikeys(config))
+	admins.DELETE("/apikeys/:keyId", DELETE_apikeys_id(config))
+	admins.POST("/decoders/:hardwareRef/test", POST_decoders_hardwareRef_test(config))
+	operators.GET("/announcements", GET_announcements(config))
+	operators.POST("/announcements", POST_announcements(config))
+	operators.PATCH("/announcements/:announcementId", PATCH_announcements_id(config))
+	operators.DELETE("/announcements/:announcementId", DELETE_announcements_id(config))
 
-func Auth0Groups(validGroups ...string) gin.HandlerFunc {
-
-	return gin.HandlerFunc(func(c *gin.Context) {
-
-		tok, err := validator.ValidateRequest(c.Request)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
-			c.Abort()
-			log.Println("Invalid token:", err)
-			return
-		}
-
-		claims := map[string]interface{}{}
-		err = validator.Claims(c.Request, tok, &claims)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
-			c.Abort()
-			log.Println("Invalid claims:", err)
-			return
-		}
-
-		c.Next()
-	})
+	return r
 }
 
 func doFlags() runtimeFlags {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	var config runtimeFlags
 	flag.StringVar(&config.configFile, `config`, ``, "Enter path for yaml file")
 	flag.Parse()
@@ -185,62 +126,3 @@ func doFlags() runtimeFlags {
 	return config
 
 }
-
-func getSensorData(influx influxConfig, sensorID string, latest bool, startDate time.Time, endDate time.Time, influxDb string) (readings []reading, err error) {
-	var q string
-	if latest {
-		q = fmt.Sprintf("SELECT last(\"value\") FROM /.*/ WHERE (\"sensor_id\" = '%s') ORDER BY time DESC LIMIT %d ", sensorID, resultLimit)
-	} else if (startDate != time.Time{}) && (endDate != time.Time{}) {
-		q = fmt.Sprintf("SELECT \"value\" FROM /.*/ WHERE (\"sensor_id\" = '%s' AND time >= '"+startDate.Format(time.RFC3339)+"' AND time <= '"+endDate.Format(time.RFC3339)+"') ORDER BY time DESC LIMIT %d ", sensorID, resultLimit)
-	} else {
-		q = fmt.Sprintf("SELECT \"value\" FROM /.*/ WHERE (\"sensor_id\" = '%s') ORDER BY time DESC LIMIT %d ", sensorID, resultLimit)
-	}
-	var response []client.Result
-	if response, err = influx.queryInfluxDB(q, influxDb); err == nil {
-		if response[0].Series == nil {
-			return nil, nil
-		}
-
-		for i := range response[0].Series[0].Values {
-			s, sErr := response[0].Series[0].Values[i][1].(json.Number).Float64()
-			t, tErr := time.Parse(time.RFC3339, response[0].Series[0].Values[i][0].(string))
-			if sErr == nil && tErr == nil {
-				var k reading
-				k.Sensor = sensorID
-				k.DateTime = t.Format("2006-01-02T15:04:05.999Z07:00")
-				k.Value = s
-				readings = append(readings, k)
-			}
-		}
-		return readings, nil
-	}
-	return readings, err
-}
-
-func getGatewaysMeta(influx influxConfig, influxDb string) (gateways []gateway, err error) {
-	var q string
-
-	q = "select last(lat) as lat,lon from stat group by gatewayMac"
-
-	var response []client.Result
-	if response, err = influx.queryInfluxDB(q, influxDb); err == nil {
-		if response[0].Series == nil {
-			return nil, nil
-		}
-
-		for i := range response[0].Series {
-			r := response[0].Series[i].Tags["gatewayMac"]
-			s, sErr := response[0].Series[i].Values[0][1].(json.Number).Float64()
-			t, tErr := response[0].Series[i].Values[0][2].(json.Number).Float64()
-			if sErr == nil && tErr == nil {
-				var k gateway
-				k.GatewayMac = r
-				k.Lat = s
-				k.Lon = t
-				gateways = append(gateways, k)
-			}
-		}
-		return gateways, nil
-	}
-	return gateways, err
-}
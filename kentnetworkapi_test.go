@@ -57,7 +57,7 @@ func TestRoutes(t *testing.T) {
 				Convey("Then the response code should be 404", nil)
 				So(w.Code, ShouldEqual, 404)
 				Convey("With the msg \"Device not found\"", nil)
-				So(w.Body.String(), ShouldEqual, "Device not found")
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Device not found")
 			})
 
 		})
@@ -78,8 +78,8 @@ func TestRoutes(t *testing.T) {
 				router.ServeHTTP(w, req)
 				Convey("Then the response code should be 404", nil)
 				So(w.Code, ShouldEqual, 404)
-				Convey("With the msg \"Device not found\"", nil)
-				So(w.Body.String(), ShouldEqual, "Device not found or device currently has no sensors")
+				Convey("With the msg \"Device not found or device currently has no sensors\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Device not found or device currently has no sensors")
 			})
 
 		})
@@ -100,8 +100,8 @@ func TestRoutes(t *testing.T) {
 				router.ServeHTTP(w, req)
 				Convey("Then the response code should be 404", nil)
 				So(w.Code, ShouldEqual, 404)
-				Convey("With the msg \"Device not found...\"", nil)
-				So(w.Body.String(), ShouldEqual, "Device not found or device has sensors with no readings")
+				Convey("With the msg \"Device not found or device has sensors with no readings\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Device not found or device has sensors with no readings")
 			})
 
 		})
@@ -137,8 +137,8 @@ func TestRoutes(t *testing.T) {
 				router.ServeHTTP(w, req)
 				Convey("Then the response code should be 404", nil)
 				So(w.Code, ShouldEqual, 404)
-				Convey("With the msg \"Device not found\"", nil)
-				So(w.Body.String(), ShouldEqual, "Sensor not found")
+				Convey("With the msg \"Sensor not found\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Sensor not found")
 			})
 
 		})
@@ -159,8 +159,8 @@ func TestRoutes(t *testing.T) {
 				router.ServeHTTP(w, req)
 				Convey("Then the response code should be 404", nil)
 				So(w.Code, ShouldEqual, 404)
-				Convey("With the msg \"Device not found\"", nil)
-				So(w.Body.String(), ShouldEqual, "Sensor not found or sensor has no readings")
+				Convey("With the msg \"Sensor not found or sensor has no readings\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Sensor not found or sensor has no readings")
 			})
 
 		})
@@ -191,10 +191,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/devices", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -205,10 +205,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/devices/device:testsen1", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -219,10 +219,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/devices/testsen1/sensors", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -233,10 +233,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/devices/testsen1/readings", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -251,10 +251,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/sensors", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -265,10 +265,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/sensors/device:testsen1:sensorid:2", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
@@ -278,10 +278,10 @@ func Test500Handling(t *testing.T) {
 			req, _ := http.NewRequest("GET", "/sensors/device:testsen1:sensorid:2/readings", nil)
 			router.ServeHTTP(w, req)
 			Convey("When an internal server error occurs", func() {
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Internal server error")
+				Convey("Then the response code should be 502", nil)
+				So(w.Code, ShouldEqual, 502)
+				Convey("With the msg \"Influxdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Influxdb connection error")
 			})
 
 		})
@@ -296,10 +296,10 @@ func Test500Handling(t *testing.T) {
 				w := httptest.NewRecorder()
 				req, _ := http.NewRequest("GET", "/data/readings", nil)
 				router.ServeHTTP(w, req)
-				Convey("Then the response code should be 500", nil)
-				So(w.Code, ShouldEqual, 500)
-				Convey("With the msg \"Internal server error\"", nil)
-				So(w.Body.String(), ShouldEqual, "Couchdb connection error")
+				Convey("Then the response code should be 503", nil)
+				So(w.Code, ShouldEqual, 503)
+				Convey("With the msg \"Couchdb connection error\"", nil)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
 			})
 
 		})
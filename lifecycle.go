@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
+	"github.com/TheThingsNetwork/go-utils/random"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/satori/go.uuid"
+)
+
+// Device documents are stored as "device:<id>", which the devices design
+// document's views rely on to tell them from other documents
+const deviceIDPrefix = "device:"
+
+// isDeviceID reports whether a document ID names a device, so other documents
+// cannot be read or changed through the device endpoints
+func isDeviceID(id string) bool {
+	return strings.HasPrefix(id, deviceIDPrefix) && !strings.Contains(id, sensorIDInfix)
+}
+
+// registryError - A failure talking to the TTN device registry, as opposed to the metadata store
+type registryError struct {
+	err error
+}
+
+func (e registryError) Error() string {
+	return "ttn: " + e.err.Error()
+}
+
+func (e registryError) Unwrap() error {
+	return e.err
+}
+
+// newTTNDevice builds a TTN registration with a random DevEUI and AppKey
+func newTTNDevice(appID string, devID string, owner string) *ttnsdk.Device {
+	dev := new(ttnsdk.Device)
+	dev.AppID = appID
+	dev.DevID = devID
+	dev.Description = fmt.Sprintf("Added through API, Owner:'%s'", owner)
+	dev.AppEUI = types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0x00, 0x00, 0x24} // Use the real AppEUI here
+
+	random.FillBytes(dev.DevEUI[:])
+
+	// Set a random AppKey
+	dev.AppKey = new(types.AppKey)
+	random.FillBytes(dev.AppKey[:])
+	return dev
+}
+
+// createDevice registers a new device with TTN and then stores it. If the
+// store rejects the device the TTN registration is removed again.
+func createDevice(ctx context.Context, config runtimeConfig, d device) (device, error) {
+	devices, done, err := config.deviceManager(ctx)
+	if err != nil {
+		return d, registryError{err}
+	}
+	defer done()
+
+	devID, err := uuid.NewV4()
+	if err != nil {
+		return d, err
+	}
+
+	dev := newTTNDevice(config.TTN.AppID, devID.String(), d.Owner)
+	if err := devices.Set(dev); err != nil {
+		return d, registryError{err}
+	}
+
+	ttn := TtnFromTtnsdkDevice(*dev)
+	d.ID = deviceIDPrefix + dev.DevID
+	d.Ttn = &ttn
+
+	created, err := config.metadataStore().CreateDevice(ctx, d)
+	if err != nil {
+		if rollbackErr := devices.Delete(dev.DevID); rollbackErr != nil {
+			contextLog(ctx).WithError(rollbackErr).With(logFields{"devId": dev.DevID}).Error("could not roll back TTN registration")
+		}
+		return d, err
+	}
+	return created, nil
+}
+
+// decommissionDevice deregisters a device from TTN and marks it decommissioned.
+// If the store cannot be updated the TTN registration is restored.
+func decommissionDevice(ctx context.Context, config runtimeConfig, deviceID string, reason string) (device, error) {
+	store := config.metadataStore()
+	d, err := store.Device(ctx, deviceID)
+	if err != nil {
+		return d, err
+	}
+
+	current := Unseen
+	if d.Status != nil {
+		current = d.Status.Type
+	}
+	if err := validTransition(current, Decommisioned); err != nil {
+		return d, err
+	}
+
+	event := status{
+		Type:     Decommisioned,
+		Reason:   reason,
+		DateTime: time.Now().UTC().Format(dateTimeLayout),
+	}
+
+	// Devices imported without TTN metadata only exist in the store
+	if d.Ttn == nil || d.Ttn.DevID == "" {
+		return store.AddStatusEvent(ctx, deviceID, event)
+	}
+
+	devices, done, err := config.deviceManager(ctx)
+	if err != nil {
+		return d, registryError{err}
+	}
+	defer done()
+
+	registration, err := devices.Get(d.Ttn.DevID)
+	if err != nil {
+		return d, registryError{err}
+	}
+	if err := devices.Delete(d.Ttn.DevID); err != nil {
+		return d, registryError{err}
+	}
+
+	updated, err := store.AddStatusEvent(ctx, deviceID, event)
+	if err != nil {
+		if rollbackErr := devices.Set(registration); rollbackErr != nil {
+			contextLog(ctx).WithError(rollbackErr).With(logFields{"devId": d.Ttn.DevID}).Error("could not restore TTN registration")
+		}
+		return d, err
+	}
+	return updated, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeTTN - An in-memory TTN device registry
+type fakeTTN struct {
+	registered map[string]*ttnsdk.Device
+	failSet    bool
+	failDelete bool
+}
+
+func newFakeTTN() *fakeTTN {
+	return &fakeTTN{registered: map[string]*ttnsdk.Device{}}
+}
+
+func (f *fakeTTN) List(limit, offset uint64) (ttnsdk.DeviceList, error) {
+	var list ttnsdk.DeviceList
+	for _, dev := range f.registered {
+		list = append(list, &dev.SparseDevice)
+	}
+	return list, nil
+}
+
+func (f *fakeTTN) Get(devID string) (*ttnsdk.Device, error) {
+	dev, ok := f.registered[devID]
+	if !ok {
+		return nil, errors.New("device not found")
+	}
+	return dev, nil
+}
+
+func (f *fakeTTN) Set(dev *ttnsdk.Device) error {
+	if f.failSet {
+		return errors.New("ttn unavailable")
+	}
+	f.registered[dev.DevID] = dev
+	return nil
+}
+
+func (f *fakeTTN) Delete(devID string) error {
+	if f.failDelete {
+		return errors.New("ttn unavailable")
+	}
+	delete(f.registered, devID)
+	return nil
+}
+
+// failingWrites - A memoryStore whose device writes fail, to exercise rollback
+type failingWrites struct {
+	*memoryStore
+}
+
+func (f failingWrites) CreateDevice(ctx context.Context, d device) (device, error) {
+	return d, errors.New("couchdb unavailable")
+}
+
+func (f failingWrites) AddStatusEvent(ctx context.Context, deviceID string, event status) (device, error) {
+	return device{}, errors.New("couchdb unavailable")
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+
+	Convey("Subject: Creating, editing and removing devices", t, func() {
+		config, store := newMemoryTestConfig()
+		registry := newFakeTTN()
+		config.devices = registry
+		router := setupRouter(config)
+
+		send := func(method, path, body string) (int, device) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			var resp struct {
+				Items device `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w.Code, resp.Items
+		}
+
+		Convey("When a device is created", func() {
+			code, created := send("POST", "/devices", `{"hardwareRef":"ultrasonic","owner":"medway","location":{"nearestTown":"Rochester"}}`)
+
+			Convey("Then it is registered with TTN and stored", func() {
+				So(code, ShouldEqual, 201)
+				So(created.Ttn, ShouldNotBeNil)
+				So(registry.registered, ShouldContainKey, created.Ttn.DevID)
+				So(created.ID, ShouldEqual, deviceIDPrefix+created.Ttn.DevID)
+				stored, err := store.Device(context.Background(), created.ID)
+				So(err, ShouldBeNil)
+				So(stored.HardwareRef, ShouldEqual, "ultrasonic")
+				So(stored.Location.NearestTown, ShouldEqual, "Rochester")
+			})
+
+			Convey("Then a patch only changes the fields given", func() {
+				code, patched := send("PATCH", "/devices/"+created.ID, `{"batteryType":"AA"}`)
+				So(code, ShouldEqual, 200)
+				So(patched.BatteryType, ShouldEqual, "AA")
+				So(patched.HardwareRef, ShouldEqual, "ultrasonic")
+				So(patched.Owner, ShouldEqual, "medway")
+			})
+
+			Convey("Then deleting it deregisters it from TTN and decommissions it", func() {
+				code, deleted := send("DELETE", "/devices/"+created.ID, "")
+				So(code, ShouldEqual, 200)
+				So(deleted.Status.Type, ShouldEqual, Decommisioned)
+				So(registry.registered, ShouldBeEmpty)
+
+				code, _ = send("DELETE", "/devices/"+created.ID, "")
+				So(code, ShouldEqual, 409)
+			})
+		})
+
+		Convey("When the store rejects a new device", func() {
+			config.metadata = failingWrites{store}
+			router = setupRouter(config)
+			code, _ := send("POST", "/devices", `{"hardwareRef":"ultrasonic"}`)
+			Convey("Then the TTN registration is rolled back", func() {
+				So(code, ShouldEqual, 502)
+				So(registry.registered, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the store cannot decommission a device", func() {
+			_, created := send("POST", "/devices", `{"hardwareRef":"ultrasonic"}`)
+			config.metadata = failingWrites{store}
+			router = setupRouter(config)
+			code, _ := send("DELETE", "/devices/"+created.ID, "")
+			Convey("Then the TTN registration is restored", func() {
+				So(code, ShouldEqual, 502)
+				So(registry.registered, ShouldContainKey, created.Ttn.DevID)
+			})
+		})
+
+		Convey("When TTN is unavailable", func() {
+			registry.failSet = true
+			code, _ := send("POST", "/devices", `{"hardwareRef":"ultrasonic"}`)
+			So(code, ShouldEqual, 502)
+			devices, _, _ := store.Devices(context.Background(), deviceFilter{}, pageRequest{})
+			So(len(devices), ShouldEqual, 1)
+		})
+
+		Convey("When a request is invalid", func() {
+			code, _ := send("POST", "/devices", `{"owner":"medway"}`)
+			So(code, ShouldEqual, 400)
+			code, _ = send("PATCH", "/devices/device:testsen1", `{}`)
+			So(code, ShouldEqual, 400)
+			code, _ = send("PATCH", "/devices/badrobot", `{"owner":"medway"}`)
+			So(code, ShouldEqual, 404)
+			code, _ = send("DELETE", "/devices/badrobot", "")
+			So(code, ShouldEqual, 404)
+		})
+
+		Convey("When a device without TTN metadata is deleted", func() {
+			code, deleted := send("DELETE", "/devices/device:testsen1", "")
+			So(code, ShouldEqual, 200)
+			So(deleted.Status.Type, ShouldEqual, Decommisioned)
+		})
+	})
+}
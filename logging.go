@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+	maxRequestIDLen = 128
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+// parseLogLevel reads a level name from the config, an empty name is info
+func parseLogLevel(name string) (logLevel, error) {
+	if name == "" {
+		return levelInfo, nil
+	}
+	for level, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// logFields - Structured context attached to a log line
+type logFields map[string]interface{}
+
+// logSink - Where log lines are written, shared by every logger
+type logSink struct {
+	mu  sync.Mutex
+	out io.Writer
+	min logLevel
+}
+
+var sink = &logSink{out: os.Stderr, min: levelInfo}
+
+// logger - Writes one JSON object per line carrying its fields
+type logger struct {
+	fields logFields
+}
+
+// logs is the root logger, loggers for a request are derived from it with With
+var logs = logger{}
+
+// With returns a logger that adds fields to every line
+func (l logger) With(fields logFields) logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return logger{fields: merged}
+}
+
+// WithError returns a logger that adds the error to every line
+func (l logger) WithError(err error) logger {
+	return l.With(logFields{"error": err.Error()})
+}
+
+func (l logger) Debug(msg string) { l.write(levelDebug, msg) }
+func (l logger) Info(msg string)  { l.write(levelInfo, msg) }
+func (l logger) Warn(msg string)  { l.write(levelWarn, msg) }
+func (l logger) Error(msg string) { l.write(levelError, msg) }
+
+func (l logger) write(level logLevel, msg string) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if level < sink.min {
+		return
+	}
+
+	line := make(logFields, len(l.fields)+3)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = logLevelNames[level]
+	line["msg"] = msg
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(logFields{"time": line["time"], "level": line["level"], "msg": msg, "logError": err.Error()})
+	}
+	sink.out.Write(append(data, '\n'))
+}
+
+// validRequestID accepts IDs from callers that are short and printable, so they
+// can be logged and forwarded as they are
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random UUID, falling back to the time if the random
+// source fails so a request is never left without an ID
+func newRequestID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return id.String()
+}
+
+// requestID - Middleware giving every request an ID, taken from X-Request-ID
+// when the caller sent a usable one, and echoing it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestIDFrom returns the ID given to the request by the requestID middleware
+func requestIDFrom(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// requestLog returns a logger carrying the request's ID
+func requestLog(c *gin.Context) logger {
+	return requestIDLog(requestIDFrom(c))
+}
+
+// accessLog - Middleware logging every request once it has been served,
+// replacing gin's text logger
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		l := requestLog(c).With(logFields{
+			"method":    c.Request.Method,
+			"path":      c.Request.URL.Path,
+			"route":     c.FullPath(),
+			"status":    c.Writer.Status(),
+			"latencyMs": float64(time.Since(start)) / float64(time.Millisecond),
+			"clientIp":  c.ClientIP(),
+		})
+		if len(c.Errors) > 0 {
+			l = l.With(logFields{"errors": c.Errors.String()})
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			l.Error("request failed")
+		case status >= 400:
+			l.Warn("request refused")
+		default:
+			l.Info("request served")
+		}
+	}
+}
+
+type requestIDContextKey struct{}
+
+// withRequestID returns a context carrying a request ID for backend calls to log and forward
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestIDFromContext returns the request ID carried by ctx, if any
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestContext returns the context backend calls for a request run under, so
+// they are cancelled when the caller goes away and are logged with and forward
+// the request's ID
+func requestContext(c *gin.Context) context.Context {
+	return withRequestID(c.Request.Context(), requestIDFrom(c))
+}
+
+// contextLog returns a logger carrying the request ID of ctx
+func contextLog(ctx context.Context) logger {
+	return requestIDLog(requestIDFromContext(ctx))
+}
+
+// requestIDLog returns a logger carrying a request ID, or the root logger
+// outside of a request
+func requestIDLog(id string) logger {
+	if id == "" {
+		return logs
+	}
+	return logs.With(logFields{"requestId": id})
+}
+
+// logBackendCall logs a call to CouchDB, InfluxDB or TTN started at start,
+// at error level when it failed and debug level otherwise
+func logBackendCall(l logger, backend, operation string, start time.Time, err error, fields logFields) {
+	l = l.With(fields).With(logFields{
+		"backend":   backend,
+		"operation": operation,
+		"latencyMs": float64(time.Since(start)) / float64(time.Millisecond),
+	})
+	if err != nil {
+		l.WithError(err).Error(backend + " call failed")
+		return
+	}
+	l.Debug(backend + " call")
+}
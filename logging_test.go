@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// captureLogs sends log lines at level and above to a buffer until the returned func is called
+func captureLogs(level logLevel) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	sink.mu.Lock()
+	out, min := sink.out, sink.min
+	sink.out, sink.min = &buf, level
+	sink.mu.Unlock()
+	return &buf, func() {
+		sink.mu.Lock()
+		sink.out, sink.min = out, min
+		sink.mu.Unlock()
+	}
+}
+
+// logLines decodes captured JSON log lines
+func logLines(buf *bytes.Buffer) (lines []map[string]interface{}) {
+	scanner := bufio.NewScanner(strings.NewReader(buf.String()))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &line) == nil {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestLogging(t *testing.T) {
+
+	var forwarded string
+	couch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(requestIDHeader)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer couch.Close()
+
+	config, _ := newMemoryTestConfig()
+	router := setupRouter(config)
+
+	request := func(router http.Handler, path, id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("Subject: Structured logs and request IDs", t, func() {
+		buf, restore := captureLogs(levelDebug)
+		defer restore()
+
+		Convey("When a caller sends a request ID", func() {
+			w := request(router, "/devices/device:testsen1", "trace-123")
+
+			Convey("Then it is echoed and logged with the request", func() {
+				So(w.Header().Get(requestIDHeader), ShouldEqual, "trace-123")
+				lines := logLines(buf)
+				So(lines, ShouldNotBeEmpty)
+				access := lines[len(lines)-1]
+				So(access["requestId"], ShouldEqual, "trace-123")
+				So(access["level"], ShouldEqual, "info")
+				So(access["route"], ShouldEqual, "/devices/:deviceId")
+				So(access["status"], ShouldEqual, 200)
+			})
+		})
+
+		Convey("When no usable request ID is sent", func() {
+			first := request(router, "/devices", "").Header().Get(requestIDHeader)
+			second := request(router, "/devices", "has spaces").Header().Get(requestIDHeader)
+			So(first, ShouldNotBeEmpty)
+			So(second, ShouldNotBeEmpty)
+			So(second, ShouldNotEqual, "has spaces")
+			So(second, ShouldNotEqual, first)
+		})
+
+		Convey("When CouchDB fails a request", func() {
+			backed := runtimeConfig{Couch: couchConfig{Host: couch.URL}}
+			w := request(setupRouter(backed), "/devices/device:testsen1", "trace-456")
+			So(w.Code, ShouldEqual, 502)
+
+			Convey("Then the ID reaches CouchDB and ties its log line to the request", func() {
+				So(forwarded, ShouldEqual, "trace-456")
+				var backend, access map[string]interface{}
+				for _, line := range logLines(buf) {
+					if line["backend"] == backendCouch {
+						backend = line
+					} else if line["route"] != nil {
+						access = line
+					}
+				}
+				So(backend, ShouldNotBeNil)
+				So(backend["requestId"], ShouldEqual, "trace-456")
+				So(backend["level"], ShouldEqual, "error")
+				So(backend["status"], ShouldEqual, 503)
+				So(access["requestId"], ShouldEqual, "trace-456")
+				So(access["level"], ShouldEqual, "error")
+			})
+		})
+
+		Convey("When the level is raised", func() {
+			sink.min = levelWarn
+			logs.Info("hidden")
+			logs.Warn("shown")
+			lines := logLines(buf)
+			So(lines, ShouldHaveLength, 1)
+			So(lines[0]["msg"], ShouldEqual, "shown")
+		})
+
+		Convey("When a log level is configured", func() {
+			level, err := parseLogLevel("DEBUG")
+			So(err, ShouldBeNil)
+			So(level, ShouldEqual, levelDebug)
+			_, err = parseLogLevel("verbose")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
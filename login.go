@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxLoginFailures   = 5                // failed attempts before a username is locked
+	maxIPLoginFailures = 20               // failed attempts before a client address is locked
+	loginFailWindow    = 15 * time.Minute // how long failed attempts are remembered
+	loginLockout       = 15 * time.Minute // how long a locked username or address is refused
+)
+
+// errLoginFailed is returned when the token endpoint rejects the credentials
+var errLoginFailed = errors.New("invalid username or password")
+
+// tokenResponse - The fields of an OAuth token response passed back to the client
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token,omitempty"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// passwordGrant exchanges a username and password for a token at the configured
+// OAuth token endpoint using the resource owner password grant
+func passwordGrant(ctx context.Context, a auth0Config, username, password string) (tok tokenResponse, err error) {
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+		"audience":   {a.audience()},
+		"client_id":  {a.ClientID},
+		"scope":      {"openid"},
+	}
+	if a.ClientSecret != "" {
+		form.Set("client_secret", a.ClientSecret)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.tokenURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return tok, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return tok, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// Auth0 answers invalid_grant with 403, other servers with 400 or 401.
+		// Other errors mean the API is misconfigured, not that the password is wrong.
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&oauthErr)
+		if oauthErr.Error == "invalid_grant" {
+			return tok, errLoginFailed
+		}
+		return tok, fmt.Errorf("login: token endpoint answered %d %q", resp.StatusCode, oauthErr.Error)
+	case resp.StatusCode != http.StatusOK:
+		return tok, fmt.Errorf("login: unexpected status %d from token endpoint", resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return tok, err
+	}
+	if tok.AccessToken == "" {
+		return tok, errors.New("login: token endpoint returned no access token")
+	}
+	return tok, nil
+}
+
+// remoteAddress returns the address the request came from. Unlike
+// c.ClientIP it ignores X-Forwarded-For and X-Real-IP, which clients can set
+// to whatever they like.
+func remoteAddress(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// loginAttempts - Failed logins counted for a username or client address
+type loginAttempts struct {
+	first       time.Time
+	count       int
+	lockedUntil time.Time
+}
+
+// expired reports whether the attempts no longer count towards a lockout
+func (a loginAttempts) expired(now time.Time) bool {
+	return now.Sub(a.first) > loginFailWindow && !a.lockedUntil.After(now)
+}
+
+// loginLimiter - Locks a username or client address out after repeated
+// failed logins. Keys are compared case-insensitively.
+type loginLimiter struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	max      int // failed attempts within loginFailWindow before locking
+	attempts map[string]loginAttempts
+	pruned   time.Time
+}
+
+func newLoginLimiter(max int) *loginLimiter {
+	return &loginLimiter{now: time.Now, max: max, attempts: map[string]loginAttempts{}}
+}
+
+// locked reports whether the key is locked out and for how long
+func (l *loginLimiter) locked(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	remaining := l.attempts[strings.ToLower(key)].lockedUntil.Sub(l.now())
+	return remaining > 0, remaining
+}
+
+// failed records a failed login, locking the key after max failures within
+// loginFailWindow
+func (l *loginLimiter) failed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	key = strings.ToLower(key)
+	a := l.attempts[key]
+	if a.lockedUntil.After(now) {
+		return
+	}
+	if a.expired(now) {
+		a = loginAttempts{first: now}
+	}
+	a.count++
+	if a.count >= l.max {
+		a = loginAttempts{lockedUntil: now.Add(loginLockout)}
+	}
+	l.attempts[key] = a
+}
+
+// succeeded forgets earlier failures of the key
+func (l *loginLimiter) succeeded(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, strings.ToLower(key))
+}
+
+// prune drops expired attempts, at most once per loginFailWindow, so keys
+// that stop failing are not kept forever
+func (l *loginLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < loginFailWindow {
+		return
+	}
+	for key, a := range l.attempts {
+		if a.expired(now) {
+			delete(l.attempts, key)
+		}
+	}
+	l.pruned = now
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogin(t *testing.T) {
+	signer := testSigner(t)
+	defer func() { validator, groupsClaim = nil, defaultGroupsClaim }()
+
+	// A stand-in OAuth token endpoint that knows a single user
+	var grants []string
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grants = append(grants, r.PostForm.Get("grant_type"))
+		if r.PostForm.Get("client_id") != "kentnetwork-api" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"access_denied","error_description":"Unauthorized"}`))
+			return
+		}
+		if r.PostForm.Get("username") != "ranger@kent.network" || r.PostForm.Get("password") != "correct horse" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		token := testToken(signer, "auth0|ranger", map[string]interface{}{"groups": []string{groupRead}})
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresIn: 86400})
+	}))
+	defer tokenEndpoint.Close()
+
+	Convey("Subject: Logging in with a username and password", t, func() {
+		config, _ := newMemoryTestConfig()
+		config.Auth0 = auth0Config{Key: "test", TokenURL: tokenEndpoint.URL, ClientID: "kentnetwork-api"}
+		router := setupRouter(config)
+		grants = nil
+
+		forwardedFor := ""
+		login := func(username, password string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(string(body)))
+			req.Header.Set("Content-Type", "application/json")
+			if forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+				req.Header.Set("X-Real-IP", forwardedFor)
+			}
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When the credentials are correct", func() {
+			w := login("ranger@kent.network", "correct horse")
+
+			Convey("Then the returned token is accepted by the other routes", func() {
+				So(w.Code, ShouldEqual, 200)
+				So(grants, ShouldResemble, []string{"password"})
+				var tok tokenResponse
+				So(json.Unmarshal(w.Body.Bytes(), &tok), ShouldBeNil)
+
+				r := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/devices", nil)
+				req.Header.Set("Authorization", tok.TokenType+" "+tok.AccessToken)
+				router.ServeHTTP(r, req)
+				So(r.Code, ShouldEqual, 200)
+			})
+		})
+
+		Convey("When the password is wrong", func() {
+			So(login("ranger@kent.network", "tr0ub4dor").Code, ShouldEqual, 401)
+		})
+
+		Convey("When a username keeps failing", func() {
+			for i := 0; i < maxLoginFailures; i++ {
+				So(login("ranger@kent.network", "guess").Code, ShouldEqual, 401)
+			}
+
+			Convey("Then it is locked out without asking the token endpoint", func() {
+				w := login("Ranger@kent.network", "correct horse")
+				So(w.Code, ShouldEqual, 429)
+				So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+				So(len(grants), ShouldEqual, maxLoginFailures)
+			})
+		})
+
+		Convey("When many usernames fail from one address", func() {
+			for i := 0; i < maxIPLoginFailures; i++ {
+				// A client rotating forwarding headers is still the same address
+				forwardedFor = "203.0.113." + strconv.Itoa(i)
+				So(login("ranger"+strconv.Itoa(i)+"@kent.network", "guess").Code, ShouldEqual, 401)
+			}
+			forwardedFor = "198.51.100.7"
+
+			Convey("Then the address is locked out for every username", func() {
+				w := login("ranger@kent.network", "correct horse")
+				So(w.Code, ShouldEqual, 429)
+				So(len(grants), ShouldEqual, maxIPLoginFailures)
+			})
+		})
+
+		Convey("When the token endpoint rejects the API's client", func() {
+			config.Auth0.ClientID = "retired-client"
+			router = setupRouter(config)
+			for i := 0; i < maxLoginFailures; i++ {
+				So(login("ranger@kent.network", "correct horse").Code, ShouldEqual, 502)
+			}
+
+			Convey("Then the user is not locked out", func() {
+				config.Auth0.ClientID = "kentnetwork-api"
+				router = setupRouter(config)
+				So(login("ranger@kent.network", "correct horse").Code, ShouldEqual, 200)
+			})
+		})
+
+		Convey("When the body is incomplete", func() {
+			So(login("ranger@kent.network", "").Code, ShouldEqual, 400)
+		})
+
+		Convey("When the token endpoint is down", func() {
+			config.Auth0.TokenURL = "http://127.0.0.1:1/oauth/token"
+			router = setupRouter(config)
+			So(login("ranger@kent.network", "correct horse").Code, ShouldEqual, 502)
+		})
+
+		Convey("When no client is configured", func() {
+			config.Auth0.ClientID = ""
+			router = setupRouter(config)
+			So(login("ranger@kent.network", "correct horse").Code, ShouldEqual, 501)
+		})
+	})
+
+	Convey("Subject: Login lockout expiry", t, func() {
+		now := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+		l := newLoginLimiter(maxLoginFailures)
+		l.now = func() time.Time { return now }
+
+		for i := 0; i < maxLoginFailures-1; i++ {
+			l.failed("ranger")
+		}
+		now = now.Add(loginFailWindow + time.Second)
+		l.failed("ranger")
+		locked, _ := l.locked("ranger")
+		So(locked, ShouldBeFalse)
+
+		for i := 0; i < maxLoginFailures; i++ {
+			l.failed("ranger")
+		}
+		locked, _ = l.locked("ranger")
+		So(locked, ShouldBeTrue)
+		now = now.Add(loginLockout)
+		locked, _ = l.locked("ranger")
+		So(locked, ShouldBeFalse)
+
+		Convey("Then usernames that stop failing are forgotten", func() {
+			for i := 0; i < 100; i++ {
+				l.failed("guess" + strconv.Itoa(i))
+			}
+			now = now.Add(loginFailWindow + time.Second)
+			l.failed("ranger")
+			So(len(l.attempts), ShouldEqual, 1)
+		})
+	})
+}
@@ -6,6 +6,9 @@ type meta struct {
 	License     string `json:"license"`
 	Version     string `json:"version"`
 	ResultLimit uint32 `json:"resultLimit"`
+	NextCursor  string `json:"nextCursor,omitempty"` // Pass as ?cursor= to fetch the next page
+
+	FailedSensors []sensorFailure `json:"failedSensors,omitempty"` // Sensors left out of a page of readings
 }
 
 func newMeta(limit int) meta {
@@ -13,6 +16,6 @@ func newMeta(limit int) meta {
 	metaData.License = "Creative Commons"
 	metaData.Publisher = "Kent Network"
 	metaData.Version = "0.1"
-	metaData.ResultLimit = resultLimit
+	metaData.ResultLimit = uint32(limit)
 	return metaData
 }
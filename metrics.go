@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "kentnetwork"
+
+// Backends whose calls are timed
+const (
+	backendCouch  = "couchdb"
+	backendInflux = "influxdb"
+)
+
+// Reasons a request is refused by the auth middleware or the TTN webhook
+const (
+	authInvalidToken       = "invalid_token"
+	authInvalidClaims      = "invalid_claims"
+	authInvalidAPIKey      = "invalid_api_key"
+	authInvalidWebhookKey  = "invalid_webhook_key"
+	authRateLimited        = "rate_limited"
+	authInsufficientGroups = "insufficient_permissions"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Requests served, by route and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "backend",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by CouchDB and InfluxDB calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "backend",
+		Name:      "errors_total",
+		Help:      "CouchDB and InfluxDB calls that failed or answered with a server error.",
+	}, []string{"backend", "operation"})
+
+	ttnCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ttn",
+		Name:      "calls_total",
+		Help:      "Calls to the TTN device registry, by outcome.",
+	}, []string{"operation", "outcome"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Requests refused by the auth middleware or the TTN webhook, by reason.",
+	}, []string{"reason"})
+
+	ttnUplinks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ttn",
+		Name:      "uplinks_total",
+		Help:      "Uplinks received from TTN, by transport and outcome.",
+	}, []string{"transport", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, backendDuration, backendErrors, ttnCalls, authFailures, ttnUplinks)
+}
+
+// observeUplink counts an uplink received over transport ("http" or "mqtt"). Uplinks
+// that can never be stored, such as those from unknown devices, count as rejected.
+func observeUplink(transport string, err error) {
+	outcome := "stored"
+	if _, ok := err.(uplinkError); ok || err == errNotFound || err == errDecommissioned {
+		outcome = "rejected"
+	} else if err != nil {
+		outcome = "failed"
+	}
+	ttnUplinks.WithLabelValues(transport, outcome).Inc()
+}
+
+// requestMetrics - Middleware counting and timing requests by their route
+// pattern, so /devices/:deviceId is one series however many devices there are
+func requestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+// observeBackend records a CouchDB or InfluxDB call started at start
+func observeBackend(backend, operation string, start time.Time, failed bool) {
+	backendDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if failed {
+		backendErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// observeTTN counts and logs a TTN registry call started at start by its outcome
+func observeTTN(l logger, operation, devID string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	ttnCalls.WithLabelValues(operation, outcome).Inc()
+
+	fields := logFields{}
+	if devID != "" {
+		fields["devId"] = devID
+	}
+	logBackendCall(l, "ttn", operation, start, err, fields)
+}
+
+// instrumentedTTN - Counts and logs the outcome of every call to the TTN device registry
+type instrumentedTTN struct {
+	ttnDevices
+	log logger
+}
+
+func (t instrumentedTTN) List(limit, offset uint64) (ttnsdk.DeviceList, error) {
+	start := time.Now()
+	devices, err := t.ttnDevices.List(limit, offset)
+	observeTTN(t.log, "list", "", start, err)
+	return devices, err
+}
+
+func (t instrumentedTTN) Get(devID string) (*ttnsdk.Device, error) {
+	start := time.Now()
+	dev, err := t.ttnDevices.Get(devID)
+	observeTTN(t.log, "get", devID, start, err)
+	return dev, err
+}
+
+func (t instrumentedTTN) Set(dev *ttnsdk.Device) error {
+	start := time.Now()
+	err := t.ttnDevices.Set(dev)
+	observeTTN(t.log, "set", dev.DevID, start, err)
+	return err
+}
+
+func (t instrumentedTTN) Delete(devID string) error {
+	start := time.Now()
+	err := t.ttnDevices.Delete(devID)
+	observeTTN(t.log, "delete", devID, start, err)
+	return err
+}
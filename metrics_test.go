@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+
+	config, _ := newMemoryTestConfig()
+	config.devices = newFakeTTN()
+	router := setupRouter(config)
+
+	request := func(router http.Handler, method, path string, header map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("Subject: Prometheus metrics", t, func() {
+
+		Convey("When a device is fetched", func() {
+			served := httpRequests.WithLabelValues("GET", "/devices/:deviceId", "200")
+			before := testutil.ToFloat64(served)
+			request(router, "GET", "/devices/device:testsen1", nil)
+
+			Convey("Then it is counted against the route pattern", func() {
+				So(testutil.ToFloat64(served), ShouldEqual, before+1)
+			})
+
+			Convey("Then /metrics exposes the request series", func() {
+				w := request(router, "GET", "/metrics", nil)
+				So(w.Code, ShouldEqual, 200)
+				So(w.Body.String(), ShouldContainSubstring, "kentnetwork_http_request_duration_seconds")
+				So(w.Body.String(), ShouldContainSubstring, `route="/devices/:deviceId"`)
+			})
+		})
+
+		Convey("When CouchDB answers with a server error", func() {
+			couch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer couch.Close()
+
+			failed := backendErrors.WithLabelValues(backendCouch, "get")
+			before := testutil.ToFloat64(failed)
+			couchConfig{Host: couch.URL}.query(context.Background(), "/kentnetwork/device:testsen1")
+			So(testutil.ToFloat64(failed), ShouldEqual, before+1)
+		})
+
+		Convey("When a TTN registration fails", func() {
+			ttn := newFakeTTN()
+			ttn.failSet = true
+			failing := config
+			failing.devices = ttn
+
+			failed := ttnCalls.WithLabelValues("set", "error")
+			before := testutil.ToFloat64(failed)
+			_, err := createDevice(context.Background(), failing, device{HardwareRef: "ultrasonic"})
+			So(err, ShouldNotBeNil)
+			So(testutil.ToFloat64(failed), ShouldEqual, before+1)
+		})
+
+		Convey("When an unknown API key is used", func() {
+			secured := config
+			secured.Auth0.Key = "test"
+			refused := authFailures.WithLabelValues(authInvalidAPIKey)
+			before := testutil.ToFloat64(refused)
+			w := request(setupRouter(secured), "GET", "/devices", map[string]string{apiKeyHeader: "knk_unknown"})
+			So(w.Code, ShouldEqual, 401)
+			So(testutil.ToFloat64(refused), ShouldEqual, before+1)
+		})
+	})
+}
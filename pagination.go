@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxResultLimit = 1000
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// pageRequest - The page size and continuation point of a list request
+type pageRequest struct {
+	Limit  int // Maximum number of items, 0 means no limit
+	Cursor pageCursor
+}
+
+// pageCursor - Where the next page starts. Clients only ever see it as an opaque token.
+type pageCursor struct {
+	Key    json.RawMessage `json:"k,omitempty"` // CouchDB view key of the first row of the next page
+	DocID  string          `json:"d,omitempty"` // CouchDB document ID of the first row of the next page
+	Sensor string          `json:"s,omitempty"` // Sensor to resume at when walking readings of several sensors
+	Before string          `json:"t,omitempty"` // Newest reading time (inclusive) of the next page
+	Skip   int             `json:"o,omitempty"` // Readings at Before already returned on earlier pages
+}
+
+func (p pageCursor) isZero() bool {
+	return len(p.Key) == 0 && p.DocID == "" && p.Sensor == "" && p.Before == "" && p.Skip == 0
+}
+
+// encode serialises the cursor for the nextCursor meta field, empty when there is no next page
+func (p pageCursor) encode() string {
+	if p.isZero() {
+		return ""
+	}
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (p pageCursor, err error) {
+	if token == "" {
+		return p, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return p, errBadCursor
+	}
+	if err = json.Unmarshal(data, &p); err != nil {
+		return p, errBadCursor
+	}
+	if p.Before != "" {
+		if _, err = time.Parse(time.RFC3339Nano, p.Before); err != nil {
+			return p, errBadCursor
+		}
+	}
+	if p.Skip < 0 || p.Skip > 0 && p.Before == "" {
+		return p, errBadCursor
+	}
+	return p, nil
+}
+
+// parsePage reads the limit and cursor query parameters
+func parsePage(c *gin.Context) (p pageRequest, err error) {
+	p.Limit = resultLimit
+	if c.Query("limit") != "" {
+		p.Limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || p.Limit < 1 || p.Limit > maxResultLimit {
+			return p, errors.New("limit must be between 1 and " + strconv.Itoa(maxResultLimit))
+		}
+	}
+	p.Cursor, err = decodeCursor(c.Query("cursor"))
+	return p, err
+}
+
+// readingFanOut bounds how many sensors' readings are fetched at once
+const readingFanOut = 8
+
+// sensorFailure - A sensor whose readings could not be fetched, left out of a page.
+// Code is the error code the request would have failed with, see backendStatus.
+type sensorFailure struct {
+	Sensor string `json:"sensor"`
+	Code   string `json:"code"`
+}
+
+// pagedSensorReadings walks the readings of several sensors in order, resuming at
+// the cursor and stopping once the page is full. Each sensor's readings are newest first.
+// Sensors are fetched readingFanOut at a time; a sensor that fails is skipped and
+// reported in failures, and err is only set when every sensor walked failed.
+func pagedSensorReadings(ctx context.Context, store ReadingStore, ids []string, q readingQuery, p pageRequest) (readings []reading, next pageCursor, failures []sensorFailure, err error) {
+	start := 0
+	if p.Cursor.Sensor != "" {
+		for start < len(ids) && ids[start] != p.Cursor.Sensor {
+			start++
+		}
+		if start == len(ids) {
+			return nil, next, nil, errBadCursor
+		}
+	}
+
+	walked := 0
+	for batch := start; batch < len(ids); batch += readingFanOut {
+		end := batch + readingFanOut
+		if end > len(ids) {
+			end = len(ids)
+		}
+		// No sensor in the batch can contribute more than what is left of the page
+		sq := q
+		sq.Limit = p.Limit - len(readings) + 1
+		var resume pageCursor
+		if batch == start {
+			resume = p.Cursor
+		}
+		results := fetchSensorReadings(ctx, store, ids[batch:end], sq, resume)
+
+		for i, result := range results {
+			walked++
+			if result.err != nil {
+				failures = append(failures, sensorFailure{Sensor: ids[batch+i], Code: errorCodes[backendStatus(result.err)]})
+				if err == nil {
+					err = result.err
+				}
+				continue
+			}
+			sensorReadings := result.readings
+
+			if len(readings)+len(sensorReadings) > p.Limit {
+				take := p.Limit - len(readings)
+				readings = append(readings, sensorReadings[:take]...)
+				next = pageCursor{Sensor: ids[batch+i], Before: sensorReadings[take].DateTime}
+				// Readings sharing the next page's first time are skipped there, so
+				// none is repeated and a run longer than a page still moves on
+				for j := take - 1; j >= 0 && sensorReadings[j].DateTime == next.Before; j-- {
+					next.Skip++
+				}
+				if batch == start && i == 0 && next.Before == p.Cursor.Before && next.Skip == take {
+					next.Skip += p.Cursor.Skip
+				}
+				return readings, next, failures, nil
+			}
+			readings = append(readings, sensorReadings...)
+
+			if len(readings) == p.Limit && batch+i+1 < len(ids) {
+				next = pageCursor{Sensor: ids[batch+i+1]}
+				return readings, next, failures, nil
+			}
+		}
+	}
+	if len(failures) == walked {
+		return nil, next, failures, err
+	}
+	if readings == nil && failures != nil {
+		// Not a 404, the failed sensors may well have readings
+		readings = []reading{}
+	}
+	return readings, next, failures, nil
+}
+
+type sensorReadingsResult struct {
+	readings []reading
+	err      error
+}
+
+// fetchSensorReadings queries the readings of each sensor concurrently, returning
+// the results in the order of ids. When resume has a time the first sensor
+// continues from it, leaving out the readings at that time already returned.
+func fetchSensorReadings(ctx context.Context, store ReadingStore, ids []string, q readingQuery, resume pageCursor) []sensorReadingsResult {
+	results := make([]sensorReadingsResult, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		sq := q
+		skip := 0
+		if i == 0 && resume.Before != "" {
+			sq.Before, _ = time.Parse(time.RFC3339Nano, resume.Before)
+			skip = resume.Skip
+			sq.Limit += skip
+		}
+		wg.Add(1)
+		go func(i int, sq readingQuery, skip int) {
+			defer wg.Done()
+			readings, err := store.SensorReadings(ctx, ids[i], sq)
+			for skip > 0 && len(readings) > 0 && readings[0].DateTime == resume.Before {
+				readings, skip = readings[1:], skip-1
+			}
+			results[i].readings, results[i].err = readings, err
+		}(i, sq, skip)
+	}
+	wg.Wait()
+	return results
+}
+
+func sensorIDs(sensors []sensor) []string {
+	ids := make([]string, len(sensors))
+	for i := range sensors {
+		ids[i] = sensors[i].ID
+	}
+	return ids
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// walkPages follows nextCursor until the last page, returning every item seen
+func walkPages(router http.Handler, path string, limit string) (items []json.RawMessage, pages int, codes []int) {
+	cursor := ""
+	for {
+		params := url.Values{"limit": {limit}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path+"?"+params.Encode(), nil)
+		router.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+		if w.Code != 200 {
+			return items, pages, codes
+		}
+
+		var body struct {
+			Meta  meta              `json:"meta"`
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		items = append(items, body.Items...)
+		pages++
+		if body.Meta.NextCursor == "" || pages > 10 {
+			return items, pages, codes
+		}
+		cursor = body.Meta.NextCursor
+	}
+}
+
+func TestPagination(t *testing.T) {
+	config, store := newMemoryTestConfig()
+	store.addDevice(device{ID: "device:testsen2"})
+	store.addDevice(device{ID: "device:testsen3"})
+	router := setupRouter(config)
+
+	Convey("Subject: Cursor based pagination", t, func() {
+
+		Convey("When /devices is walked one device at a time", func() {
+			items, pages, _ := walkPages(router, "/devices", "1")
+			Convey("Then every device is returned exactly once", func() {
+				So(pages, ShouldEqual, 3)
+				So(len(items), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When /sensors is walked with a page larger than the result", func() {
+			items, pages, _ := walkPages(router, "/sensors", "10")
+			Convey("Then a single page without a cursor is returned", func() {
+				So(pages, ShouldEqual, 1)
+				So(len(items), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When /data/readings is walked two readings at a time", func() {
+			items, pages, _ := walkPages(router, "/data/readings", "2")
+			Convey("Then the walk crosses sensors without losing readings", func() {
+				So(pages, ShouldEqual, 2)
+				So(len(items), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When a single sensor's readings are walked one at a time", func() {
+			items, pages, _ := walkPages(router, "/sensors/device:testsen1:sensorid:1/readings", "1")
+			Convey("Then the time continuation returns each reading once", func() {
+				So(pages, ShouldEqual, 2)
+				So(len(items), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When many readings share a time at the page boundary", func() {
+			dupConfig, dupStore := newMemoryTestConfig()
+			for i := 0; i < 5; i++ {
+				dupStore.addReadings(reading{Sensor: "device:testsen1:sensorid:2", DateTime: "2018-03-01T10:30:00Z", Value: float64(10 + i)})
+			}
+			items, pages, _ := walkPages(setupRouter(dupConfig), "/sensors/device:testsen1:sensorid:2/readings", "2")
+
+			Convey("Then each reading is returned once and the walk moves past them", func() {
+				So(pages, ShouldEqual, 3)
+				So(len(items), ShouldEqual, 6)
+				seen := map[float64]bool{}
+				for _, item := range items {
+					var r reading
+					json.Unmarshal(item, &r)
+					So(seen[r.Value], ShouldBeFalse)
+					seen[r.Value] = true
+				}
+				So(seen[7.5], ShouldBeTrue)
+			})
+		})
+
+		Convey("When the limit is out of range", func() {
+			_, _, codes := walkPages(router, "/devices", "100000")
+			So(codes[0], ShouldEqual, 400)
+		})
+
+		Convey("When the cursor is not one we issued", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices?cursor=not-a-cursor", nil)
+			router.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 400)
+		})
+	})
+}
+
+// failingReadings - A memoryStore whose readings of some sensors cannot be fetched
+type failingReadings struct {
+	*memoryStore
+	fail map[string]bool
+}
+
+func (f failingReadings) SensorReadings(ctx context.Context, sensorID string, q readingQuery) ([]reading, error) {
+	if f.fail[sensorID] {
+		return nil, errors.New("influx unavailable")
+	}
+	return f.memoryStore.SensorReadings(ctx, sensorID, q)
+}
+
+func TestReadingFanOut(t *testing.T) {
+
+	Convey("Subject: Fetching the readings of many sensors at once", t, func() {
+		config, store := newMemoryTestConfig()
+		var ids []string
+		for i := 0; i < 2*readingFanOut+3; i++ {
+			id := fmt.Sprintf("device:testsen1:sensorid:x%02d", i)
+			ids = append(ids, id)
+			store.addSensor(sensor{ID: id, ParentDevice: "device:testsen1", SensorType: "riverLevel", Unit: "m"})
+			store.addReadings(
+				reading{Sensor: id, DateTime: "2018-03-01T10:00:00Z", Value: float64(i)},
+				reading{Sensor: id, DateTime: "2018-03-01T10:15:00Z", Value: float64(i)},
+			)
+		}
+		router := setupRouter(config)
+
+		Convey("When the readings are walked across several batches", func() {
+			items, _, _ := walkPages(router, "/data/readings", "5")
+			Convey("Then each sensor's readings come together, in sensor order, newest first", func() {
+				So(len(items), ShouldEqual, 2*len(ids)+3)
+				var seen []reading
+				for _, item := range items {
+					var r reading
+					json.Unmarshal(item, &r)
+					seen = append(seen, r)
+				}
+				for i, id := range ids {
+					So(seen[3+2*i].Sensor, ShouldEqual, id)
+					So(seen[3+2*i].DateTime, ShouldEqual, "2018-03-01T10:15:00Z")
+					So(seen[4+2*i].Sensor, ShouldEqual, id)
+				}
+			})
+		})
+
+		Convey("When some sensors cannot be read", func() {
+			config.readings = failingReadings{store, map[string]bool{ids[1]: true, ids[readingFanOut+1]: true}}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/data/readings?limit=1000", nil)
+			setupRouter(config).ServeHTTP(w, req)
+
+			var body struct {
+				Meta  meta      `json:"meta"`
+				Items []reading `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+
+			Convey("Then the others are returned and the failures reported", func() {
+				So(w.Code, ShouldEqual, 200)
+				So(len(body.Items), ShouldEqual, 2*len(ids)+3-4)
+				So(body.Meta.FailedSensors, ShouldResemble, []sensorFailure{
+					{Sensor: ids[1], Code: "bad_gateway"},
+					{Sensor: ids[readingFanOut+1], Code: "bad_gateway"},
+				})
+			})
+		})
+
+		Convey("When no sensor can be read", func() {
+			fail := map[string]bool{"device:testsen1:sensorid:1": true, "device:testsen1:sensorid:2": true}
+			for _, id := range ids {
+				fail[id] = true
+			}
+			config.readings = failingReadings{store, fail}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/data/readings", nil)
+			setupRouter(config).ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 502)
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/satori/go.uuid"
+)
+
+func GET_announcements(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta     meta             `json:"meta"`
+			Messages []serviceMessage `json:"items"`
+		}
+
+		messages, err := config.metadataStore().ServiceMessages(ctx)
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+
+		// Build OK response, expired announcements are kept for the record
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Messages = messages
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+func POST_announcements(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type postData struct {
+			Title   string     `json:"title"`
+			Message string     `json:"message"`
+			Service string     `json:"service"`
+			Expires *time.Time `json:"expires"`
+		}
+
+		type okResponse struct {
+			Meta    meta           `json:"meta"`
+			Message serviceMessage `json:"items"`
+		}
+
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+
+		id, err := uuid.NewV4()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Unable to generate announcement ID")
+			return
+		}
+		now := time.Now().UTC()
+		m := serviceMessage{
+			ID:          announcementIDPrefix + id.String(),
+			Service:     data.Service,
+			Title:       data.Title,
+			Message:     data.Message,
+			Created:     now,
+			LastUpdated: now,
+			Expires:     data.Expires,
+		}
+		if err := validAnnouncement(m); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		created, err := config.metadataStore().CreateServiceMessage(ctx, m)
+		if err != nil {
+			announcementWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Message = created
+
+		c.JSON(http.StatusCreated, a)
+	}
+}
+
+func PATCH_announcements_id(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta    meta           `json:"meta"`
+			Message serviceMessage `json:"items"`
+		}
+
+		patch := announcementPatch{}
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		if patch == (announcementPatch{}) {
+			respondError(c, http.StatusBadRequest, "Nothing to update, expected title, message, service or expires")
+			return
+		}
+
+		updated, err := config.metadataStore().UpdateServiceMessage(ctx, c.Param("announcementId"), patch, time.Now().UTC())
+		if err != nil {
+			announcementWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Message = updated
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// DELETE_announcements_id - Expires an announcement now so it leaves GET /status
+func DELETE_announcements_id(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta    meta           `json:"meta"`
+			Message serviceMessage `json:"items"`
+		}
+
+		now := time.Now().UTC()
+		expired, err := config.metadataStore().UpdateServiceMessage(ctx, c.Param("announcementId"), announcementPatch{Expires: &now}, now)
+		if err != nil {
+			announcementWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Message = expired
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// announcementWriteError answers a failed announcement write with the matching status
+func announcementWriteError(c *gin.Context, err error) {
+	if _, ok := err.(announcementError); ok {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch err {
+	case errNotFound:
+		respondError(c, http.StatusNotFound, "Announcement not found")
+	case errConflict:
+		respondError(c, http.StatusConflict, "Announcement was modified concurrently or already exists")
+	default:
+		respondBackendError(c, "Couchdb connection error", err)
+	}
+}
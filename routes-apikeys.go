@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GET_apikeys(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta meta     `json:"meta"`
+			Keys []apiKey `json:"items"`
+		}
+
+		keys, err := config.metadataStore().APIKeys(ctx)
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+
+		// Build OK response, admins see the keys of every organisation
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Keys = visibleAPIKeys(visibilityFrom(c), keys)
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+func POST_apikeys(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type postData struct {
+			Name      string   `json:"name" binding:"required"`
+			Scopes    []string `json:"scopes" binding:"required"`
+			RateLimit int      `json:"rateLimit"`
+		}
+
+		// The key itself is only ever returned here
+		type okResponse struct {
+			Meta meta   `json:"meta"`
+			Key  string `json:"key"`
+			Item apiKey `json:"items"`
+		}
+
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+
+		k := apiKey{
+			Name:      data.Name,
+			Owner:     "unknown",
+			Scopes:    data.Scopes,
+			RateLimit: data.RateLimit,
+			Created:   time.Now().UTC().Format(dateTimeLayout),
+		}
+		if who, ok := callerFrom(c); ok {
+			if who.APIKey != "" {
+				respondError(c, http.StatusForbidden, "API keys cannot issue other API keys")
+				return
+			}
+			k.Owner = who.Org
+		}
+		if err := validAPIKey(&k); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		secret, err := newAPIKeySecret()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Unable to generate key")
+			return
+		}
+		k.ID = apiKeyID(secret)
+
+		created, err := config.metadataStore().CreateAPIKey(ctx, k)
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Key = secret
+		a.Item = created
+
+		c.JSON(http.StatusCreated, a)
+	}
+}
+
+func DELETE_apikeys_id(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		store := config.metadataStore()
+		_, err := manageableAPIKey(ctx, store, visibilityFrom(c), c.Param("keyId"))
+		if err == nil {
+			err = store.RemoveAPIKey(ctx, c.Param("keyId"))
+		}
+		if err == errNotFound {
+			respondError(c, http.StatusNotFound, "API key not found")
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
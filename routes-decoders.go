@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST_decoders_hardwareRef_test - Decodes a hex payload with a hardware type's
+// decoder, to check a device's payloads before it is deployed
+func POST_decoders_hardwareRef_test(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		type postData struct {
+			Payload string `json:"payload" binding:"required"` // Hex, spaces and a 0x prefix are ignored
+		}
+
+		type okResponse struct {
+			Meta   meta           `json:"meta"`
+			Values []decodedValue `json:"items"`
+		}
+
+		decode, ok := decoders.lookup(c.Param("hardwareRef"))
+		if !ok {
+			respondErrorDetails(c, http.StatusNotFound, "No decoder for this hardware", gin.H{"hardwareRefs": decoders.hardwareRefs()})
+			return
+		}
+
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		payload, err := hex.DecodeString(strings.TrimPrefix(strings.Join(strings.Fields(data.Payload), ""), "0x"))
+		if err != nil {
+			respondParamError(c, "Payload must be hex", err)
+			return
+		}
+
+		values, err := decode(payload)
+		if err != nil {
+			respondParamError(c, "Payload could not be decoded", err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Values = values
+
+		c.JSON(http.StatusOK, a)
+	}
+}
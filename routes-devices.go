@@ -1,64 +1,46 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
 	"net/http"
-	"strconv"
 	"time"
 
-	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
-	"github.com/TheThingsNetwork/go-utils/random"
-	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/gin-gonic/gin"
-	"github.com/satori/go.uuid"
 )
 
 func GET_devices(config runtimeConfig) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		// catchmentName := c.Query("catchmentName")
-		// associatedWith := c.Query("associatedWith")
-		// status := c.Query("status")
-		// town := c.Query("town")
-		//lat := c.Query("loc-lat")
-		//lon := c.Query("loc-lon")
-		//radius := c.Query("loc-radius")
+		ctx := requestContext(c)
 
 		type okResponse struct {
 			Meta    meta     `json:"meta"`
 			Devices []device `json:"items"`
 		}
 
-		type couchView struct {
-			TotalRows int `json:"total_rows"`
-			Offset    int `json:"offset"`
-			Rows      []struct {
-				ID     string      `json:"id"`
-				Key    interface{} `json:"key"`
-				Value  interface{} `json:"value"`
-				Device device      `json:"doc"`
-			} `json:"rows"`
+		page, err := parsePage(c)
+		if err != nil {
+			respondParamError(c, "User supplied parameter error", err)
+			return
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/_design/devices/_view/getDevices?include_docs=true")
-		if err != nil && code != 200 {
-			c.String(500, "Couchdb connection error")
+		filter, err := parseDeviceFilter(c)
+		if err != nil {
+			respondParamError(c, "User supplied parameter error", err)
 			return
 		}
+		filter.Visible = visibilityFrom(c)
 
-		var couchResp couchView
-		if err = json.Unmarshal(resp, &couchResp); err != nil {
-			c.String(500, "Unmarshalling error")
+		devices, next, err := config.metadataStore().Devices(ctx, filter, page)
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
 		// Build OK response
 		var a okResponse
-		a.Meta = newMeta(resultLimit)
-		for i := range couchResp.Rows {
-			a.Devices = append(a.Devices, couchResp.Rows[i].Device)
-		}
+		a.Meta = newMeta(page.Limit)
+		a.Meta.NextCursor = next.encode()
+		a.Devices = devices
 
 		c.JSON(http.StatusOK, a)
 	}
@@ -66,25 +48,20 @@ func GET_devices(config runtimeConfig) func(c *gin.Context) {
 
 func GET_devices_id(config runtimeConfig) func(c *gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
 		type okResponse struct {
 			Meta   meta   `json:"meta"`
 			Device device `json:"items"`
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/" + c.Param("deviceId"))
-		if err != nil || code == 500 {
-			c.String(500, "Couchdb connection error")
+		returnedDevice, err := visibleDevice(ctx, config.metadataStore(), visibilityFrom(c), c.Param("deviceId"))
+		if err == errNotFound {
+			respondError(c, http.StatusNotFound, "Device not found")
 			return
 		}
-		if code == 404 {
-			c.String(404, "Device not found")
-			return
-		}
-
-		var returnedDevice device
-		if err = json.Unmarshal(resp, &returnedDevice); err != nil {
-			c.String(500, "Unmarshalling error")
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
@@ -99,218 +76,425 @@ func GET_devices_id(config runtimeConfig) func(c *gin.Context) {
 }
 func GET_devices_id_sensors(config runtimeConfig) func(c *gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
 		type okResponse struct {
 			Meta    meta     `json:"meta"`
 			Sensors []sensor `json:"items"`
 		}
 
-		type couchView struct {
-			TotalRows int `json:"total_rows"`
-			Offset    int `json:"offset"`
-			Rows      []struct {
-				ID     string      `json:"id"`
-				Key    string      `json:"key"`
-				Value  interface{} `json:"value"`
-				Sensor sensor      `json:"doc"`
-			} `json:"rows"`
-		}
-
-		code, resp, err := config.Couch.query("/kentnetwork/_design/sensors/_view/getByDeviceID?include_docs=true&startkey=\"" + c.Param("deviceId") + "\"&endkey=\"" + c.Param("deviceId") + "\ufff0\"")
-		if err != nil && code != 200 {
-			c.String(500, "Couchdb connection error")
-			return
-		}
-
-		var couchResp couchView
-		if err = json.Unmarshal(resp, &couchResp); err != nil {
-			c.String(500, "Unmarshalling error")
+		sensors, err := visibleDeviceSensors(ctx, config.metadataStore(), visibilityFrom(c), c.Param("deviceId"))
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		if len(couchResp.Rows) == 0 {
-			c.String(404, "Device not found or device currently has no sensors")
+		if len(sensors) == 0 {
+			respondError(c, http.StatusNotFound, "Device not found or device currently has no sensors")
 			return
 		}
 
 		// Build OK response
 		var a okResponse
 		a.Meta = newMeta(resultLimit)
-		for i := range couchResp.Rows {
-			a.Sensors = append(a.Sensors, couchResp.Rows[i].Sensor)
-		}
+		a.Sensors = sensors
 
 		c.JSON(http.StatusOK, a)
 
 	}
 }
 
+// GET_device_id_readings - Readings of every sensor of a device, grouped by sensor
+// unless ?format=flat asks for the original single list
 func GET_device_id_readings(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
-		// latest := c.Query("latest")       // latest values
-		// today := c.Query("today")         // values for date
-		// date := c.Query("date")           //values on date
-		// since := c.Query("since")         // values since date
-		// startDate := c.Query("startDate") // values from start_date until end_date
-		// endDate := c.Query("endDate")     // values from start_date until end_date
-		// if !(((startDate != "") && (endDate != "")) ||
-		// 	((startDate == "") && (endDate == ""))) {
-		// 	c.String(400, "Invalid parameters")
-		// 	return
-		// }
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Meta     meta      `json:"meta"`
 			Readings []reading `json:"items"`
 		}
 
-		type couchView struct {
-			TotalRows int `json:"total_rows"`
-			Offset    int `json:"offset"`
-			Rows      []struct {
-				ID    string      `json:"id"`
-				Key   string      `json:"key"`
-				Value interface{} `json:"value"`
-			} `json:"rows"`
-		}
-
-		var paramErr error
-		latest := false
-		validDate := false
-		var startDate time.Time
-		var endDate time.Time
-
-		if c.Query("latest") != "" {
-			latest, paramErr = strconv.ParseBool(c.Query("latest"))
-		} else if c.Query("startDate") != "" {
-			startDate, paramErr = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("startDate"))
-			if c.Query("endDate") != "" {
-				endDate, paramErr = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("endDate"))
-			} else {
-				endDate = time.Now()
-			}
-			if paramErr == nil {
-				validDate = true
-			}
+		type groupedResponse struct {
+			Meta    meta                 `json:"meta"`
+			Sensors []sensorReadingGroup `json:"items"`
+		}
+
+		q, paramErr := parseReadingWindow(c)
+		if paramErr != nil {
+			respondParamError(c, "User supplied parameter error", paramErr)
+			return
 		}
 
+		page, paramErr := parsePage(c)
+		if paramErr != nil {
+			respondParamError(c, "User supplied parameter error", paramErr)
+			return
+		}
+		if paramErr = parseAggregation(c, &q, page.Limit); paramErr != nil {
+			respondParamError(c, "User supplied parameter error", paramErr)
+			return
+		}
+		grouped, paramErr := parseReadingsFormat(c)
 		if paramErr != nil {
-			c.String(400, "User supplied parameter error")
+			respondParamError(c, "User supplied parameter error", paramErr)
 			return
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/_design/sensors/_view/getByDeviceID?startkey=\"" + c.Param("deviceId") + "\"&endkey=\"" + c.Param("deviceId") + "\ufff0\"")
-		if err != nil && code != 200 {
-			c.String(500, "Couchdb connection error")
+		sensors, err := visibleDeviceSensors(ctx, config.metadataStore(), visibilityFrom(c), c.Param("deviceId"))
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
+			return
+		}
+
+		if len(sensors) == 0 {
+			respondError(c, http.StatusNotFound, "Device not found or device has sensors with no readings")
+			return
+		}
+
+		readings, next, failures, err := pagedSensorReadings(ctx, config.readingStore(), sensorIDs(sensors), q, page)
+		if err == errBadCursor {
+			respondParamError(c, "User supplied parameter error", err)
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Influxdb connection error", err)
+			return
+		}
+
+		if readings == nil {
+			respondError(c, http.StatusNotFound, "Device not found or device has sensors with no readings")
+			return
+		}
+
+		m := newMeta(page.Limit)
+		m.NextCursor = next.encode()
+		m.FailedSensors = failures
+
+		// Build OK response
+		if grouped {
+			c.JSON(http.StatusOK, groupedResponse{Meta: m, Sensors: groupReadings(sensors, readings)})
 			return
 		}
+		c.JSON(http.StatusOK, okResponse{Meta: m, Readings: readings})
+	}
+}
+
+// sensorReadingGroup - A sensor and its readings on a page of device readings
+type sensorReadingGroup struct {
+	Sensor   sensor    `json:"sensor"`
+	Readings []reading `json:"readings"`
+}
+
+// parseReadingsFormat reads the format query parameter, true when readings are to be grouped by sensor
+func parseReadingsFormat(c *gin.Context) (grouped bool, err error) {
+	switch c.DefaultQuery("format", "grouped") {
+	case "grouped":
+		return true, nil
+	case "flat":
+		return false, nil
+	}
+	return false, errors.New("format must be grouped or flat")
+}
+
+// groupReadings splits a page of readings into one group per sensor, in the
+// order the sensors were walked. Sensors without readings on the page are left out.
+func groupReadings(sensors []sensor, readings []reading) []sensorReadingGroup {
+	byID := make(map[string]sensor, len(sensors))
+	for _, s := range sensors {
+		byID[s.ID] = s
+	}
 
-		var couchResp couchView
-		if err = json.Unmarshal(resp, &couchResp); err != nil {
-			c.String(500, "Unmarshalling error")
+	groups := []sensorReadingGroup{}
+	for _, r := range readings {
+		if n := len(groups); n > 0 && groups[n-1].Sensor.ID == r.Sensor {
+			groups[n-1].Readings = append(groups[n-1].Readings, r)
+			continue
+		}
+		groups = append(groups, sensorReadingGroup{Sensor: byID[r.Sensor], Readings: []reading{r}})
+	}
+	return groups
+}
+
+func GET_devices_id_status(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta   meta     `json:"meta"`
+			Events []status `json:"items"`
+		}
+
+		_, err := visibleDevice(ctx, config.metadataStore(), visibilityFrom(c), c.Param("deviceId"))
+		if err == errNotFound {
+			respondError(c, http.StatusNotFound, "Device not found")
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		if len(couchResp.Rows) == 0 {
-			c.String(404, "Device not found or device has sensors with no readings")
+		events, err := config.metadataStore().StatusEvents(ctx, c.Param("deviceId"))
+		if err == errNotFound {
+			respondError(c, http.StatusNotFound, "Device not found")
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
 		// Build OK response
 		var a okResponse
 		a.Meta = newMeta(resultLimit)
+		a.Events = events
 
-		for i := range couchResp.Rows {
+		c.JSON(http.StatusOK, a)
+	}
+}
 
-			var readings []reading
-			if latest == false && validDate == false {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, false, time.Time{}, time.Time{}, config.Influx.Db)
-			} else if latest {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, true, time.Time{}, time.Time{}, config.Influx.Db)
-			} else if validDate {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, false, startDate, endDate, config.Influx.Db)
-			}
+func POST_devices_id_status(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
-			if err != nil {
-				c.String(500, "Influxdb connection error")
-				return
-			}
+		type postData struct {
+			Type   eventType `json:"type" binding:"required"`
+			Reason string    `json:"reason"`
+		}
 
-			if a.Readings == nil {
-				c.String(404, "Device not found or device has sensors with no readings")
-				return
-			}
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Device device `json:"items"`
+		}
 
-			for i := range readings {
-				a.Readings = append(a.Readings, readings[i])
-			}
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		if data.Type < Unseen || int(data.Type) > len(events) {
+			respondError(c, http.StatusBadRequest, "Unknown status type")
+			return
+		}
+		if data.Type == Decommisioned {
+			// Decommissioning also deregisters the device from TTN
+			respondError(c, http.StatusBadRequest, "Use DELETE /devices/{deviceId} to decommission a device")
+			return
+		}
 
+		event := status{
+			Type:     data.Type,
+			Reason:   data.Reason,
+			DateTime: time.Now().UTC().Format(dateTimeLayout),
 		}
 
-		c.JSON(http.StatusOK, a)
+		store := config.metadataStore()
+		if _, err := manageableDevice(ctx, store, visibilityFrom(c), c.Param("deviceId")); err != nil {
+			deviceWriteError(c, err)
+			return
+		}
+
+		updated, err := store.AddStatusEvent(ctx, c.Param("deviceId"), event)
+		if err != nil {
+			deviceWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Device = updated
+
+		c.JSON(http.StatusCreated, a)
 	}
 }
 
+// PUT_devices - Kept for older clients, creates a device named only by its owner
 func PUT_devices(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
 		type putData struct {
 			Name  string `json:"name" binding:"required"`
 			owner string
 		}
 
-		type newDev struct {
-			*putData
-			ID uuid.UUID `json:"id"`
-		}
-
 		data := putData{}
-		if err := c.BindJSON(&data); err != nil {
+		if err := c.ShouldBindJSON(&data); err != nil {
 			// TODO: less informative error message
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to parse Body: %s", err.Error())})
+			respondParamError(c, "Failed to parse body", err)
 			return
 		}
 		data.owner = "unknown"
+		if v := visibilityFrom(c); v.Restricted {
+			data.owner = v.Org
+		}
+
+		created, err := createDevice(ctx, config, device{
+			HardwareRef: "unknown",
+			BatteryType: "unknown",
+			Owner:       data.owner,
+		})
+		if err != nil {
+			deviceWriteError(c, err)
+			return
+		}
 
-		client := config.TTN.connect()
-		defer client.Close()
+		c.JSON(http.StatusOK, created)
+	}
+}
+
+func POST_devices(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type postData struct {
+			Location    *location `json:"location"`
+			HardwareRef string    `json:"hardwareRef" binding:"required"`
+			BatteryType string    `json:"batteryType"`
+			Owner       string    `json:"owner"`
+			Public      bool      `json:"public"`
+		}
+
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Device device `json:"items"`
+		}
 
-		devices, err := client.ManageDevices()
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		// Callers limited to their organisation can only create devices for it
+		v := visibilityFrom(c)
+		if v.Restricted {
+			if data.Owner != "" && data.Owner != v.Org {
+				respondError(c, http.StatusForbidden, "Devices can only be created for your own organisation")
+				return
+			}
+			data.Owner = v.Org
+		}
+		if data.Owner == "" {
+			data.Owner = "unknown"
+		}
+
+		created, err := createDevice(ctx, config, device{
+			Location:    data.Location,
+			HardwareRef: data.HardwareRef,
+			BatteryType: data.BatteryType,
+			Owner:       data.Owner,
+			Public:      data.Public,
+		})
 		if err != nil {
-			log.Printf("my-amazing-app: could not create device: %s", err.Error())
+			deviceWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Device = created
+
+		c.JSON(http.StatusCreated, a)
+	}
+}
+
+func PATCH_devices_id(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Device device `json:"items"`
+		}
+
+		patch := devicePatch{}
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		if patch == (devicePatch{}) {
+			respondError(c, http.StatusBadRequest, "Nothing to update, expected location, hardwareRef, batteryType, owner or public")
+			return
+		}
+
+		v := visibilityFrom(c)
+		if patch.Owner != nil && v.Restricted {
+			respondError(c, http.StatusForbidden, "Only admins can move a device to another organisation")
 			return
 		}
 
-		devID, err := uuid.NewV4()
+		store := config.metadataStore()
+		if _, err := manageableDevice(ctx, store, v, c.Param("deviceId")); err != nil {
+			deviceWriteError(c, err)
+			return
+		}
+
+		updated, err := store.UpdateDevice(ctx, c.Param("deviceId"), patch)
 		if err != nil {
-			panic(err)
+			deviceWriteError(c, err)
+			return
 		}
 
-		dev := new(ttnsdk.Device)
-		dev.AppID = config.TTN.AppID
-		dev.DevID = devID.String()
-		dev.Description = fmt.Sprintf("Added through API, Owner:'%s'", data.owner)
-		dev.AppEUI = types.AppEUI{0x70, 0xB3, 0xD5, 0x7E, 0xF0, 0x00, 0x00, 0x24} // Use the real AppEUI here
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Device = updated
+
+		c.JSON(http.StatusOK, a)
+	}
+}
 
-		random.FillBytes(dev.DevEUI[:])
+func DELETE_devices_id(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
-		// Set a random AppKey
-		dev.AppKey = new(types.AppKey)
-		random.FillBytes(dev.AppKey[:])
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Device device `json:"items"`
+		}
 
-		if err := devices.Set(dev); err != nil {
-			log.Printf("my-amazing-app: could not create device: %s", err.Error())
+		if _, err := manageableDevice(ctx, config.metadataStore(), visibilityFrom(c), c.Param("deviceId")); err != nil {
+			deviceWriteError(c, err)
 			return
 		}
 
-		ttn := TtnFromTtnsdkDevice(*dev)
-		device := device{
-			ID:          dev.DevID,
-			HardwareRef: "unknown",
-			BatteryType: "unknown",
-			Ttn:         &ttn,
-			Owner:       data.owner,
+		updated, err := decommissionDevice(ctx, config, c.Param("deviceId"), "Deleted through API")
+		if err != nil {
+			deviceWriteError(c, err)
+			return
 		}
 
-		c.JSON(http.StatusOK, device)
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Device = updated
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// deviceWriteError responds to a failed device create, update or decommission
+func deviceWriteError(c *gin.Context, err error) {
+	switch err.(type) {
+	case registryError:
+		respondBackendError(c, "TTN connection error", err)
+		return
+	case transitionError:
+		respondError(c, http.StatusConflict, err.Error())
+		return
+	}
 
+	switch err {
+	case errNotFound:
+		respondError(c, http.StatusNotFound, "Device not found")
+	case errForbidden:
+		respondError(c, http.StatusForbidden, "Device belongs to another organisation")
+	case errConflict:
+		respondError(c, http.StatusConflict, "Device was modified concurrently or already exists")
+	default:
+		respondBackendError(c, "Couchdb connection error", err)
 	}
 }
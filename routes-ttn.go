@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST_ttn_uplink - Receives uplinks from the TTN HTTP integration. The
+// integration must send the configured webhook key as its Authorization header.
+func POST_ttn_uplink(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type okResponse struct {
+			Meta     meta      `json:"meta"`
+			Readings []reading `json:"items"`
+		}
+
+		if config.TTN.WebhookKey == "" {
+			respondError(c, http.StatusNotImplemented, "TTN webhook is not configured")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte(config.TTN.WebhookKey)) != 1 {
+			authFailures.WithLabelValues(authInvalidWebhookKey).Inc()
+			respondError(c, http.StatusUnauthorized, "Invalid webhook key")
+			return
+		}
+
+		var up ttnUplink
+		if err := c.ShouldBindJSON(&up); err != nil {
+			observeUplink("http", uplinkError{err.Error()})
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+
+		readings, err := handleUplink(ctx, config, up, time.Now())
+		observeUplink("http", err)
+		if err != nil {
+			uplinkWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Readings = readings
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// uplinkWriteError responds to an uplink that could not be stored
+func uplinkWriteError(c *gin.Context, err error) {
+	if _, ok := err.(uplinkError); ok {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch err {
+	case errNotFound:
+		respondError(c, http.StatusNotFound, "Device not found")
+	case errDecommissioned:
+		respondError(c, http.StatusConflict, "Device is decommissioned")
+	default:
+		respondBackendError(c, "Could not store uplink", err)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,15 +11,20 @@ import (
 
 func GET_gateways(config runtimeConfig) func(c *gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
 		type okResponse struct {
 			Meta     meta      `json:"meta"`
 			Gateways []gateway `json:"items"`
 		}
 
-		gateways, err := getGatewaysMeta(config.Influx, "gatewayrxpkts")
+		gateways, err := config.readingStore().Gateways(ctx)
 		if err != nil {
-			c.String(500, "Internal server error")
+			respondBackendError(c, "Influxdb connection error", err)
+			return
+		}
+		if gateways, err = visibleGateways(ctx, config.metadataStore(), visibilityFrom(c), gateways); err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
@@ -33,40 +38,36 @@ func GET_gateways(config runtimeConfig) func(c *gin.Context) {
 
 func GET_sensors(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Meta    meta     `json:"meta"`
 			Sensors []sensor `json:"items"`
 		}
 
-		type couchView struct {
-			TotalRows int `json:"total_rows"`
-			Offset    int `json:"offset"`
-			Rows      []struct {
-				ID     string      `json:"id"`
-				Key    interface{} `json:"key"`
-				Value  interface{} `json:"value"`
-				Sensor sensor      `json:"doc"`
-			} `json:"rows"`
+		page, err := parsePage(c)
+		if err != nil {
+			respondParamError(c, "User supplied parameter error", err)
+			return
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/_design/sensors/_view/getSensors?include_docs=true")
-		if err != nil && code != 200 {
-			c.String(500, "Couchdb connection error")
+		filter, err := visibleSensors(ctx, config.metadataStore(), visibilityFrom(c))
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		var couchResp couchView
-		if err = json.Unmarshal(resp, &couchResp); err != nil {
-			c.String(500, "Unmarshalling error")
+		sensors, next, err := config.metadataStore().Sensors(ctx, filter, page)
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
 		// Build OK response
 		var a okResponse
-		a.Meta = newMeta(resultLimit)
-		for i := range couchResp.Rows {
-			a.Sensors = append(a.Sensors, couchResp.Rows[i].Sensor)
-		}
+		a.Meta = newMeta(page.Limit)
+		a.Meta.NextCursor = next.encode()
+		a.Sensors = sensors
 
 		c.JSON(http.StatusOK, a)
 	}
@@ -74,194 +75,426 @@ func GET_sensors(config runtimeConfig) func(*gin.Context) {
 
 func GET_sensors_id(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Meta   meta   `json:"meta"`
 			Sensor sensor `json:"items"`
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/" + c.Param("sensorId"))
-		if err != nil || code == 500 {
-			c.String(500, "Couchdb connection error")
+		returnedSensor, err := visibleSensor(ctx, config.metadataStore(), visibilityFrom(c), c.Param("sensorId"))
+		if err == errNotFound {
+			respondError(c, http.StatusNotFound, "Sensor not found")
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		if code == 404 {
-			c.String(404, "Sensor not found")
+		// Build OK response
+		var a okResponse
+		a.Sensor = returnedSensor
+		a.Meta = newMeta(resultLimit)
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+func POST_sensors(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type postData struct {
+			ParentDevice   string `json:"parentDevice" binding:"required"`
+			SensorType     string `json:"sensorType" binding:"required"`
+			Unit           string `json:"unit" binding:"required"`
+			UpdateInterval uint32 `json:"updateInterval" binding:"required"`
+		}
+
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Sensor sensor `json:"items"`
+		}
+
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
 			return
 		}
 
-		var returnedSensor sensor
-		if err = json.Unmarshal(resp, &returnedSensor); err != nil {
-			c.String(500, "Unmarshalling error")
+		created, err := createSensor(ctx, config.metadataStore(), visibilityFrom(c), sensor{
+			ParentDevice:   data.ParentDevice,
+			SensorType:     data.SensorType,
+			Unit:           data.Unit,
+			UpdateInterval: data.UpdateInterval,
+		})
+		if err != nil {
+			sensorWriteError(c, err)
 			return
 		}
 
 		// Build OK response
 		var a okResponse
-		a.Sensor = returnedSensor
 		a.Meta = newMeta(resultLimit)
+		a.Sensor = created
+
+		c.JSON(http.StatusCreated, a)
+	}
+}
+
+func PATCH_sensors_id(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		type patchData struct {
+			sensorPatch
+			ParentDevice *string `json:"parentDevice"`
+		}
+
+		type okResponse struct {
+			Meta   meta   `json:"meta"`
+			Sensor sensor `json:"items"`
+		}
+
+		data := patchData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		if data.ParentDevice != nil {
+			respondError(c, http.StatusBadRequest, "parentDevice cannot be changed, create a new sensor on the other device instead")
+			return
+		}
+		if data.sensorPatch == (sensorPatch{}) {
+			respondError(c, http.StatusBadRequest, "Nothing to update, expected sensorType, unit or updateInterval")
+			return
+		}
+
+		store := config.metadataStore()
+		if _, err := manageableSensor(ctx, store, visibilityFrom(c), c.Param("sensorId")); err != nil {
+			sensorWriteError(c, err)
+			return
+		}
+
+		updated, err := store.UpdateSensor(ctx, c.Param("sensorId"), data.sensorPatch)
+		if err != nil {
+			sensorWriteError(c, err)
+			return
+		}
+
+		// Build OK response
+		var a okResponse
+		a.Meta = newMeta(resultLimit)
+		a.Sensor = updated
 
 		c.JSON(http.StatusOK, a)
 	}
 }
 
+func DELETE_sensors_id(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
+		store := config.metadataStore()
+		if _, err := manageableSensor(ctx, store, visibilityFrom(c), c.Param("sensorId")); err != nil {
+			sensorWriteError(c, err)
+			return
+		}
+
+		if err := store.RemoveSensor(ctx, c.Param("sensorId")); err != nil {
+			sensorWriteError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// sensorWriteError responds to a failed sensor create, update or delete
+func sensorWriteError(c *gin.Context, err error) {
+	if _, ok := err.(sensorError); ok {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch err {
+	case errNotFound:
+		respondError(c, http.StatusNotFound, "Sensor not found")
+	case errForbidden:
+		respondError(c, http.StatusForbidden, "Sensor belongs to another organisation")
+	case errConflict:
+		respondError(c, http.StatusConflict, "Sensor was modified concurrently or already exists")
+	default:
+		respondBackendError(c, "Couchdb connection error", err)
+	}
+}
+
 func GET_sensors_id_readings(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Meta     meta      `json:"meta"`
 			Readings []reading `json:"items"`
 		}
 
-		var err error
-		latest := false
-		validDate := false
-		var startDate time.Time
-		var endDate time.Time
-
-		if c.Query("latest") != "" {
-			latest, err = strconv.ParseBool(c.Query("latest"))
-		} else if c.Query("startDate") != "" {
-			startDate, err = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("startDate"))
-			if c.Query("endDate") != "" {
-				endDate, err = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("endDate"))
-			} else {
-				endDate = time.Now()
-			}
-			if err == nil {
-				validDate = true
-			}
+		q, err := parseReadingWindow(c)
+		if err != nil {
+			respondParamError(c, "User supplied parameter error", err)
+			return
 		}
 
+		page, err := parsePage(c)
 		if err != nil {
-			c.String(400, "User supplied parameter error")
+			respondParamError(c, "User supplied parameter error", err)
+			return
+		}
+		if err = parseAggregation(c, &q, page.Limit); err != nil {
+			respondParamError(c, "User supplied parameter error", err)
 			return
 		}
 
-		var readings []reading
-		if latest == false && validDate == false {
-			readings, err = getSensorData(config.Influx, c.Param("sensorId"), false, time.Time{}, time.Time{}, config.Influx.Db)
-		} else if latest {
-			readings, err = getSensorData(config.Influx, c.Param("sensorId"), true, time.Time{}, time.Time{}, config.Influx.Db)
-		} else if validDate {
-			readings, err = getSensorData(config.Influx, c.Param("sensorId"), false, startDate, endDate, config.Influx.Db)
+		if v := visibilityFrom(c); v.Restricted {
+			_, err = visibleSensor(ctx, config.metadataStore(), v, c.Param("sensorId"))
+			if err == errNotFound {
+				respondError(c, http.StatusNotFound, "Sensor not found or sensor has no readings")
+				return
+			}
+			if err != nil {
+				respondBackendError(c, "Couchdb connection error", err)
+				return
+			}
 		}
 
+		readings, next, failures, err := pagedSensorReadings(ctx, config.readingStore(), []string{c.Param("sensorId")}, q, page)
+		if err == errBadCursor {
+			respondParamError(c, "User supplied parameter error", err)
+			return
+		}
 		if err != nil {
-			c.String(500, "Influxdb connection error")
+			respondBackendError(c, "Influxdb connection error", err)
 			return
 		}
 
 		if readings == nil {
-			c.String(404, "Sensor not found or sensor has no readings")
+			respondError(c, http.StatusNotFound, "Sensor not found or sensor has no readings")
 			return
 		}
 
 		// Build OK response
 		var a okResponse
-		a.Meta = newMeta(resultLimit)
+		a.Meta = newMeta(page.Limit)
+		a.Meta.NextCursor = next.encode()
+		a.Meta.FailedSensors = failures
 		a.Readings = readings
 		c.JSON(http.StatusOK, a)
 
 	}
 }
 
+// POST_sensors_id_readings - Stores readings of one sensor from a source outside TTN
+func POST_sensors_id_readings(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		var writes []readingWrite
+		if err := c.ShouldBindJSON(&writes); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		for i := range writes {
+			if writes[i].Sensor == "" {
+				writes[i].Sensor = c.Param("sensorId")
+			}
+			if writes[i].Sensor != c.Param("sensorId") {
+				readingWriteError(c, readingError{i, writes[i].Sensor, errors.New("sensor does not match the path")})
+				return
+			}
+		}
+		storeReadings(c, config, writes)
+	}
+}
+
+// POST_data_readings - Stores readings of any number of sensors in one batch
+func POST_data_readings(config runtimeConfig) func(*gin.Context) {
+	return func(c *gin.Context) {
+		var writes []readingWrite
+		if err := c.ShouldBindJSON(&writes); err != nil {
+			respondParamError(c, "Failed to parse body", err)
+			return
+		}
+		storeReadings(c, config, writes)
+	}
+}
+
+// storeReadings checks and writes submitted readings, answering with those stored
+func storeReadings(c *gin.Context, config runtimeConfig, writes []readingWrite) {
+	type okResponse struct {
+		Meta     meta      `json:"meta"`
+		Readings []reading `json:"items"`
+	}
+
+	if len(writes) == 0 || len(writes) > maxReadingBatch {
+		respondError(c, http.StatusBadRequest, "Expected between 1 and "+strconv.Itoa(maxReadingBatch)+" readings")
+		return
+	}
+
+	ctx := requestContext(c)
+	points, err := checkReadings(ctx, config.metadataStore(), visibilityFrom(c), writes, time.Now())
+	if err != nil {
+		readingWriteError(c, err)
+		return
+	}
+	if err = config.readingStore().WriteReadings(ctx, points); err != nil {
+		respondBackendError(c, "Influxdb connection error", err)
+		return
+	}
+
+	// Build OK response
+	var a okResponse
+	a.Meta = newMeta(maxReadingBatch)
+	for _, p := range points {
+		a.Readings = append(a.Readings, p.reading)
+	}
+
+	c.JSON(http.StatusCreated, a)
+}
+
+// readingWriteError responds to submitted readings that could not be checked
+func readingWriteError(c *gin.Context, err error) {
+	e, ok := err.(readingError)
+	if !ok {
+		respondBackendError(c, "Couchdb connection error", err)
+		return
+	}
+
+	details := gin.H{"index": e.Index, "sensor": e.Sensor}
+	switch e.Err {
+	case errNotFound:
+		respondErrorDetails(c, http.StatusNotFound, "Sensor not found", details)
+	case errForbidden:
+		respondErrorDetails(c, http.StatusForbidden, "Sensor belongs to another organisation", details)
+	default:
+		respondErrorDetails(c, http.StatusBadRequest, e.Error(), details)
+	}
+}
+
 func GET_data_readings(config runtimeConfig) func(*gin.Context) {
 	return func(c *gin.Context) {
-		// latest := c.Query("latest")       // latest values
-		// today := c.Query("today")         // values for date
-		// date := c.Query("date")           //values on date
-		// since := c.Query("since")         // values since date
-		//startDate := c.Query("startDate") // values from start_date until end_date
-		//endDate := c.Query("endDate")     // values from start_date until end_date
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Meta     meta      `json:"meta"`
 			Readings []reading `json:"items"`
 		}
 
-		type couchView struct {
-			TotalRows int `json:"total_rows"`
-			Offset    int `json:"offset"`
-			Rows      []struct {
-				ID    string      `json:"id"`
-				Key   string      `json:"key"`
-				Value interface{} `json:"value"`
-			} `json:"rows"`
-		}
-
-		var err error
-		latest := false
-		validDate := false
-		var startDate time.Time
-		var endDate time.Time
-
-		if c.Query("latest") != "" {
-			latest, err = strconv.ParseBool(c.Query("latest"))
-		} else if c.Query("startDate") != "" {
-			startDate, err = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("startDate"))
-			if c.Query("endDate") != "" {
-				endDate, err = time.Parse("2006-01-02T15:04:05.999Z07:00", c.Query("endDate"))
-			} else {
-				endDate = time.Now()
-			}
-			if err == nil {
-				validDate = true
-			}
+		q, err := parseReadingWindow(c)
+		if err != nil {
+			respondParamError(c, "User supplied parameter error", err)
+			return
 		}
 
+		page, err := parsePage(c)
 		if err != nil {
-			c.String(400, "User supplied parameter error")
+			respondParamError(c, "User supplied parameter error", err)
+			return
+		}
+		if err = parseAggregation(c, &q, page.Limit); err != nil {
+			respondParamError(c, "User supplied parameter error", err)
 			return
 		}
 
-		code, resp, err := config.Couch.query("/kentnetwork/_design/sensors/_view/getSensors")
-		if err != nil && code != 200 {
-			c.String(500, "Couchdb connection error")
+		filter, err := visibleSensors(ctx, config.metadataStore(), visibilityFrom(c))
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		var couchResp couchView
-		if err = json.Unmarshal(resp, &couchResp); err != nil {
-			c.String(500, "Unmarshalling error")
+		sensors, _, err := config.metadataStore().Sensors(ctx, filter, pageRequest{})
+		if err != nil {
+			respondBackendError(c, "Couchdb connection error", err)
 			return
 		}
 
-		if len(couchResp.Rows) == 0 {
-			c.String(404, "No sensors found or system has sensors with no readings")
+		if len(sensors) == 0 {
+			respondError(c, http.StatusNotFound, "No sensors found or system has sensors with no readings")
+			return
+		}
+
+		readings, next, failures, err := pagedSensorReadings(ctx, config.readingStore(), sensorIDs(sensors), q, page)
+		if err == errBadCursor {
+			respondParamError(c, "User supplied parameter error", err)
+			return
+		}
+		if err != nil {
+			respondBackendError(c, "Influxdb connection error", err)
+			return
+		}
+
+		if readings == nil {
+			respondError(c, http.StatusNotFound, "No sensors found or system has sensors with no readings")
 			return
 		}
 
 		// Build OK response
 		var a okResponse
-		a.Meta = newMeta(resultLimit)
+		a.Meta = newMeta(page.Limit)
+		a.Meta.NextCursor = next.encode()
+		a.Meta.FailedSensors = failures
+		a.Readings = readings
+
+		c.JSON(http.StatusOK, a)
+	}
+}
 
-		for i := range couchResp.Rows {
+func POST_login(config runtimeConfig) func(*gin.Context) {
+	users := newLoginLimiter(maxLoginFailures)
+	addresses := newLoginLimiter(maxIPLoginFailures)
 
-			var readings []reading
-			if latest == false && validDate == false {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, false, time.Time{}, time.Time{}, config.Influx.Db)
-			} else if latest {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, true, time.Time{}, time.Time{}, config.Influx.Db)
-			} else if validDate {
-				readings, err = getSensorData(config.Influx, couchResp.Rows[i].ID, false, startDate, endDate, config.Influx.Db)
-			}
+	return func(c *gin.Context) {
+		ctx := requestContext(c)
 
-			if err != nil {
-				c.String(500, "Influxdb connection error")
-				return
-			}
+		type postData struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
 
-			if readings != nil {
-				for i := range readings {
-					a.Readings = append(a.Readings, readings[i])
-				}
-			}
+		if config.Auth0.ClientID == "" {
+			respondError(c, http.StatusNotImplemented, "Login is not configured")
+			return
 		}
 
-		if a.Readings == nil {
-			c.String(404, "No sensors found or system has sensors with no readings")
+		data := postData{}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			respondParamError(c, "Failed to parse body", err)
 			return
 		}
 
-		c.JSON(http.StatusOK, a)
+		// Guessing is limited per username and per client address, so neither one
+		// account nor many accounts can be tried endlessly
+		addr := remoteAddress(c)
+		locked, remaining := users.locked(data.Username)
+		if addrLocked, addrRemaining := addresses.locked(addr); addrLocked && addrRemaining > remaining {
+			locked, remaining = true, addrRemaining
+		}
+		if locked {
+			c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			respondError(c, http.StatusTooManyRequests, "Too many failed logins, try again later")
+			return
+		}
+
+		tok, err := passwordGrant(ctx, config.Auth0, data.Username, data.Password)
+		if err == errLoginFailed {
+			users.failed(data.Username)
+			addresses.failed(addr)
+			respondError(c, http.StatusUnauthorized, "Failed to login")
+			return
+		}
+		if err != nil {
+			contextLog(ctx).WithError(err).Error("login failed")
+			respondError(c, http.StatusBadGateway, "Login service unavailable")
+			return
+		}
+		users.succeeded(data.Username)
+
+		c.JSON(http.StatusOK, tok)
 	}
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	minUpdateInterval = 1    // minutes
+	maxUpdateInterval = 1440 // one reading a day
+)
+
+// sensorUnits - The catalogue of sensor types and the units each may report in
+var sensorUnits = map[string][]string{
+	"riverLevel":     {"m", "mm"},
+	"rainfall":       {"mm"},
+	"temperature":    {"C"},
+	"humidity":       {"%"},
+	"pressure":       {"hPa"},
+	"batteryVoltage": {"V"},
+}
+
+// sensorError - A sensor document that breaks one of the catalogue rules
+type sensorError struct {
+	msg string
+}
+
+func (e sensorError) Error() string {
+	return e.msg
+}
+
+// sensorPatch - The editable fields of a sensor, nil fields are left unchanged. The
+// parent device is fixed as sensor IDs are prefixed with it for the getByDeviceID view.
+type sensorPatch struct {
+	UpdateInterval *uint32 `json:"updateInterval"`
+	SensorType     *string `json:"sensorType"`
+	Unit           *string `json:"unit"`
+}
+
+// apply copies the fields set in the patch onto a sensor
+func (p sensorPatch) apply(s *sensor) {
+	if p.UpdateInterval != nil {
+		s.UpdateInterval = *p.UpdateInterval
+	}
+	if p.SensorType != nil {
+		s.SensorType = *p.SensorType
+	}
+	if p.Unit != nil {
+		s.Unit = *p.Unit
+	}
+}
+
+// validSensor checks a sensor's type and unit against the catalogue and that
+// its update interval is between a minute and a day
+func validSensor(s sensor) error {
+	units, ok := sensorUnits[s.SensorType]
+	if !ok {
+		types := make([]string, 0, len(sensorUnits))
+		for t := range sensorUnits {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return sensorError{fmt.Sprintf("unknown sensorType %q, expected one of %s", s.SensorType, strings.Join(types, ", "))}
+	}
+
+	known := false
+	for _, u := range units {
+		known = known || u == s.Unit
+	}
+	if !known {
+		return sensorError{fmt.Sprintf("unit %q is not valid for %s, expected one of %s", s.Unit, s.SensorType, strings.Join(units, ", "))}
+	}
+
+	if s.UpdateInterval < minUpdateInterval || s.UpdateInterval > maxUpdateInterval {
+		return sensorError{fmt.Sprintf("updateInterval must be between %d and %d minutes", minUpdateInterval, maxUpdateInterval)}
+	}
+	return nil
+}
+
+// sensorIDInfix separates a sensor's number from its parent device's ID
+const sensorIDInfix = ":sensorid:"
+
+// sensorIDPrefix returns the prefix shared by the IDs of a device's sensors
+func sensorIDPrefix(deviceID string) string {
+	return deviceID + sensorIDInfix
+}
+
+// isSensorID reports whether a document ID names a sensor of a device
+func isSensorID(id string) bool {
+	i := strings.Index(id, sensorIDInfix)
+	return i > 0 && isDeviceID(id[:i])
+}
+
+// highestSensorNumber returns the highest number among a device's sensor IDs
+func highestSensorNumber(deviceID string, existing []sensor) int {
+	highest := 0
+	for _, s := range existing {
+		if n, err := strconv.Atoi(strings.TrimPrefix(s.ID, sensorIDPrefix(deviceID))); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// createSensor validates a new sensor, checks the caller may add sensors to its
+// parent device and stores it under the next number for that device. Numbers
+// are never handed out twice, so a new sensor does not inherit the readings of
+// a removed one.
+func createSensor(ctx context.Context, store MetadataStore, v visibility, s sensor) (sensor, error) {
+	if err := validSensor(s); err != nil {
+		return s, err
+	}
+
+	parent, err := manageableDevice(ctx, store, v, s.ParentDevice)
+	if err == errNotFound {
+		return s, sensorError{fmt.Sprintf("parentDevice %q does not exist", s.ParentDevice)}
+	}
+	if err != nil {
+		return s, err
+	}
+	if parent.Status != nil && parent.Status.Type == Decommisioned {
+		return s, sensorError{fmt.Sprintf("parentDevice %q is decommissioned", s.ParentDevice)}
+	}
+
+	existing, err := store.DeviceSensors(ctx, s.ParentDevice)
+	if err != nil {
+		return s, err
+	}
+	// Devices created before numbers were recorded start after their highest sensor
+	n, err := store.NextSensorNumber(ctx, s.ParentDevice, highestSensorNumber(s.ParentDevice, existing))
+	if err != nil {
+		return s, err
+	}
+	s.ID = sensorIDPrefix(s.ParentDevice) + strconv.Itoa(n)
+	return store.CreateSensor(ctx, s)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSensorWrites(t *testing.T) {
+
+	Convey("Subject: Creating, editing and removing sensors", t, func() {
+		config, store := newMemoryTestConfig()
+		router := setupRouter(config)
+
+		send := func(method, path, body string) (int, sensor) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			var resp struct {
+				Items sensor `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w.Code, resp.Items
+		}
+
+		Convey("When a sensor is added to a device", func() {
+			code, created := send("POST", "/sensors", `{"parentDevice":"device:testsen1","sensorType":"rainfall","unit":"mm","updateInterval":30}`)
+
+			Convey("Then it is numbered after the device's existing sensors", func() {
+				So(code, ShouldEqual, 201)
+				So(created.ID, ShouldEqual, "device:testsen1:sensorid:3")
+				sensors, _ := store.DeviceSensors(context.Background(), "device:testsen1")
+				So(len(sensors), ShouldEqual, 3)
+			})
+
+			Convey("Then its unit can be changed within its type", func() {
+				code, _ := send("PATCH", "/sensors/"+created.ID, `{"unit":"C"}`)
+				So(code, ShouldEqual, 400)
+				code, updated := send("PATCH", "/sensors/"+created.ID, `{"updateInterval":60}`)
+				So(code, ShouldEqual, 200)
+				So(updated.UpdateInterval, ShouldEqual, 60)
+				So(updated.Unit, ShouldEqual, "mm")
+			})
+
+			Convey("Then it can be removed", func() {
+				code, _ := send("DELETE", "/sensors/"+created.ID, "")
+				So(code, ShouldEqual, 204)
+				_, err := store.Sensor(context.Background(), created.ID)
+				So(err, ShouldEqual, errNotFound)
+
+				Convey("Then its ID is not given to the next sensor", func() {
+					code, replacement := send("POST", "/sensors", `{"parentDevice":"device:testsen1","sensorType":"rainfall","unit":"mm","updateInterval":30}`)
+					So(code, ShouldEqual, 201)
+					So(replacement.ID, ShouldEqual, "device:testsen1:sensorid:4")
+				})
+			})
+		})
+
+		Convey("When a sensor breaks the catalogue rules", func() {
+			for _, body := range []string{
+				`{"parentDevice":"device:testsen1","sensorType":"windSpeed","unit":"m/s","updateInterval":15}`,
+				`{"parentDevice":"device:testsen1","sensorType":"temperature","unit":"F","updateInterval":15}`,
+				`{"parentDevice":"device:testsen1","sensorType":"temperature","unit":"C","updateInterval":100000}`,
+				`{"parentDevice":"device:testsen1","sensorType":"temperature","unit":"C"}`,
+				`{"parentDevice":"badrobot","sensorType":"temperature","unit":"C","updateInterval":15}`,
+			} {
+				code, _ := send("POST", "/sensors", body)
+				So(code, ShouldEqual, 400)
+			}
+		})
+
+		Convey("When the parent device is decommissioned", func() {
+			store.AddStatusEvent(context.Background(), "device:testsen1", status{Type: Decommisioned})
+			code, _ := send("POST", "/sensors", `{"parentDevice":"device:testsen1","sensorType":"rainfall","unit":"mm","updateInterval":30}`)
+			So(code, ShouldEqual, 400)
+		})
+
+		Convey("When a sensor is moved to another device", func() {
+			code, _ := send("PATCH", "/sensors/device:testsen1:sensorid:1", `{"parentDevice":"device:other"}`)
+			Convey("Then it is refused so IDs keep their device prefix", func() {
+				So(code, ShouldEqual, 400)
+			})
+		})
+
+		Convey("When an unknown sensor is changed", func() {
+			code, _ := send("PATCH", "/sensors/badrobot", `{"updateInterval":60}`)
+			So(code, ShouldEqual, 404)
+			code, _ = send("DELETE", "/sensors/badrobot", "")
+			So(code, ShouldEqual, 404)
+		})
+	})
+}
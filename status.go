@@ -1,82 +1,276 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
 	"github.com/gin-gonic/gin"
 )
 
+// Service states, in increasing order of severity
+const (
+	statusOK       = "ok"
+	statusWarning  = "warning"  // Slower than health.warnLatency
+	statusDegraded = "degraded" // Slower than health.degradedLatency, or a non-critical service is down
+	statusError    = "error"
+)
+
+var statusSeverity = map[string]int{statusOK: 0, statusWarning: 1, statusDegraded: 2, statusError: 3}
+
+// Services reported by GET /status
+const (
+	serviceCouch  = "couchDB"
+	serviceInflux = "influx"
+	serviceMemory = "memoryStore"
+	serviceTTN    = "ttn"
+)
+
+var healthServices = []string{serviceCouch, serviceInflux, serviceMemory, serviceTTN}
+
+// ttnStatusTTL - How long GET /status reuses the result of probing TTN. The
+// endpoint is public, so callers must not be able to open a TTN connection each.
+const ttnStatusTTL = 15 * time.Second
+
+// serviceMessage - An operator announcement, such as planned maintenance, about
+// the whole API or a single service
 type serviceMessage struct {
-	Title       string    `json:"title"`
-	Created     time.Time `json:"created"`
-	LastUpdated time.Time `json:lastupdated"`
-	Message     string    `json:"message"`
+	ID          string     `json:"@id,omitempty"`
+	Service     string     `json:"service,omitempty"` // Empty for the whole API
+	Title       string     `json:"title"`
+	Created     time.Time  `json:"created"`
+	LastUpdated time.Time  `json:"lastUpdated"`
+	Expires     *time.Time `json:"expires,omitempty"` // Hidden from GET /status once passed
+	Message     string     `json:"message"`
 }
 
 type serviceStatus struct {
-	Service  string           `json:"service"`
-	Status   string           `json:"status"`
-	Messages []serviceMessage `json:"messages"`
+	Service   string           `json:"service"`
+	Status    string           `json:"status"`
+	Critical  bool             `json:"critical"` // Whether the API is unusable without it
+	LatencyMs float64          `json:"latencyMs"`
+	Error     string           `json:"error,omitempty"`
+	Messages  []serviceMessage `json:"messages"`
+}
+
+// healthCheck - A probe of one dependency. A failing non-critical dependency
+// only degrades the API as reads keep working without it.
+type healthCheck struct {
+	Service  string
+	Critical bool
+	Probe    func(timeout time.Duration) error
 }
 
-func getCouchStatus(config runtimeConfig) serviceStatus {
-	status := "ok"
+// healthChecks returns the probes for the configured backends
+func (c runtimeConfig) healthChecks() []healthCheck {
+	var checks []healthCheck
+	if c.Store == "memory" {
+		checks = append(checks, healthCheck{Service: serviceMemory, Critical: true, Probe: func(time.Duration) error { return nil }})
+	} else {
+		checks = append(checks,
+			healthCheck{Service: serviceInflux, Critical: true, Probe: c.Influx.ping},
+			healthCheck{Service: serviceCouch, Critical: true, Probe: c.Couch.ping},
+		)
+	}
+	return append(checks, healthCheck{Service: serviceTTN, Probe: c.pingTTN})
+}
 
-	_, err := http.Get(config.Couch.Host + "/")
+// ping checks CouchDB answers its welcome document
+func (c couchConfig) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	code, _, err := c.query(ctx, "/")
 	if err != nil {
-		status = "error"
+		return err
 	}
+	if code != http.StatusOK {
+		return fmt.Errorf("couchdb: unexpected status %d", code)
+	}
+	return nil
+}
+
+// ping checks InfluxDB answers its ping endpoint
+func (c influxConfig) ping(timeout time.Duration) error {
+	if c.client == nil {
+		return errors.New("influx client not initialised")
+	}
+	_, _, err := c.client.Ping(timeout)
+	return err
+}
 
-	return serviceStatus{
-		Service:  "couchDB",
-		Status:   status,
-		Messages: []serviceMessage{},
+// pingTTN checks the TTN handler of the application can list its devices. The
+// TTN SDK takes no context, so once the timeout passes the client is closed to
+// abandon the calls still in flight.
+func (c runtimeConfig) pingTTN(timeout time.Duration) error {
+	l := contextLog(context.Background())
+	devices := c.devices
+	var client ttnsdk.Client
+	if devices == nil {
+		client = c.TTN.connect()
+		defer client.Close()
 	}
 
+	result := make(chan error, 1)
+	go func() {
+		if client != nil {
+			start := time.Now()
+			manager, err := client.ManageDevices()
+			observeTTN(l, "connect", "", start, err)
+			if err != nil {
+				result <- err
+				return
+			}
+			devices = manager
+		}
+		_, err := instrumentedTTN{devices, l}.List(1, 0)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response within %s", timeout)
+	}
 }
 
-func getInfluxStatus(config runtimeConfig) serviceStatus {
-	status := "ok"
+// cachedProbe - Runs a probe at most once per ttl, sharing its result with
+// the callers in between
+type cachedProbe struct {
+	mu    sync.Mutex
+	probe func(timeout time.Duration) error
+	ttl   time.Duration
+	at    time.Time
+	err   error
+}
 
-	//TODO: goto warning when ping is slow...
-	_, _, err := config.Influx.client.Ping(10)
-	if err != nil {
-		status = "error"
+func (p *cachedProbe) run(timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.at.IsZero() && time.Since(p.at) < p.ttl {
+		return p.err
 	}
+	p.err = p.probe(timeout)
+	p.at = time.Now()
+	return p.err
+}
 
-	return serviceStatus{
-		Service:  "influx",
-		Status:   status,
-		Messages: []serviceMessage{},
+// runHealthChecks probes every dependency concurrently, giving up on a probe
+// after health.timeout
+func runHealthChecks(checks []healthCheck, h healthConfig) []serviceStatus {
+	statuses := make([]serviceStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			result := make(chan error, 1)
+			go func() { result <- check.Probe(h.timeout()) }()
+
+			var err error
+			select {
+			case err = <-result:
+			case <-time.After(h.timeout()):
+				err = fmt.Errorf("no response within %s", h.timeout())
+			}
+			statuses[i] = serviceStatus{
+				Service:   check.Service,
+				Critical:  check.Critical,
+				Status:    h.latencyStatus(time.Since(start), err),
+				LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+				Messages:  []serviceMessage{},
+			}
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+		}(i, check)
 	}
+	wg.Wait()
+	return statuses
+}
 
+// overallStatus is the most severe service status. A non-critical service that
+// is down only degrades the API.
+func overallStatus(services []serviceStatus) string {
+	overall := statusOK
+	for _, s := range services {
+		status := s.Status
+		if status == statusError && !s.Critical {
+			status = statusDegraded
+		}
+		if statusSeverity[status] > statusSeverity[overall] {
+			overall = status
+		}
+	}
+	return overall
 }
 
 func GET_status(config runtimeConfig) func(c *gin.Context) {
+	ttn := &cachedProbe{probe: config.pingTTN, ttl: ttnStatusTTL}
 	return func(c *gin.Context) {
+		ctx := requestContext(c)
+
 		type okResponse struct {
 			Status   string           `json:"status"`
 			Services []serviceStatus  `json:"services"`
 			Messages []serviceMessage `json:"messages"`
 		}
 
-		services := []serviceStatus{
-			getInfluxStatus(config),
-			getCouchStatus(config),
+		// Build OK response
+		checks := config.healthChecks()
+		for i := range checks {
+			if checks[i].Service == serviceTTN {
+				checks[i].Probe = ttn.run
+			}
 		}
 
-		// Build OK response
 		var a okResponse
-		a.Status = "ok"
-		a.Services = services
-		a.Messages = []serviceMessage{serviceMessage{
-			Title:       "test message",
-			Created:     time.Now(),
-			LastUpdated: time.Now(),
-			Message:     "I think it's ok",
-		},
+		a.Services = runHealthChecks(checks, config.Health)
+		a.Status = overallStatus(a.Services)
+
+		// Announcements are best effort, the store being down is already reported above
+		messages, err := config.metadataStore().ServiceMessages(ctx)
+		if err != nil {
+			messages = nil
+		}
+		a.Messages = attachAnnouncements(messages, a.Services, time.Now())
+
+		code := http.StatusOK
+		if a.Status == statusError {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, a)
+	}
+}
+
+// GET_healthz - Liveness, answers as long as the process can serve requests
+func GET_healthz(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": statusOK})
+	}
+}
+
+// GET_readyz - Readiness, fails while a critical dependency is down
+func GET_readyz(config runtimeConfig) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var critical []healthCheck
+		for _, check := range config.healthChecks() {
+			if check.Critical {
+				critical = append(critical, check)
+			}
+		}
+
+		services := runHealthChecks(critical, config.Health)
+		status := overallStatus(services)
+		code := http.StatusOK
+		if status == statusError {
+			code = http.StatusServiceUnavailable
 		}
-		c.JSON(http.StatusOK, a)
+		c.JSON(code, gin.H{"status": status, "services": services})
 	}
 }
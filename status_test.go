@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// unreachableTTN - A TTN registry whose handler cannot be reached
+type unreachableTTN struct {
+	*fakeTTN
+}
+
+func (unreachableTTN) List(limit, offset uint64) (ttnsdk.DeviceList, error) {
+	return nil, errors.New("handler unreachable")
+}
+
+// stalledTTN - A TTN registry whose handler never answers until released
+type stalledTTN struct {
+	*fakeTTN
+	calls   *int32
+	release chan struct{}
+}
+
+func (s stalledTTN) List(limit, offset uint64) (ttnsdk.DeviceList, error) {
+	atomic.AddInt32(s.calls, 1)
+	<-s.release
+	return nil, nil
+}
+
+func TestHealthStatus(t *testing.T) {
+
+	// Probes abandoned after the timeout may still be reading these
+	var couchMu sync.Mutex
+	var couchDelay time.Duration
+	couchCode := http.StatusOK
+	setCouch := func(delay time.Duration, code int) {
+		couchMu.Lock()
+		defer couchMu.Unlock()
+		couchDelay, couchCode = delay, code
+	}
+	couch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		couchMu.Lock()
+		delay, code := couchDelay, couchCode
+		couchMu.Unlock()
+		time.Sleep(delay)
+		w.WriteHeader(code)
+		w.Write([]byte(`{"couchdb":"Welcome"}`))
+	}))
+	defer couch.Close()
+
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	config, err := runtimeConfig{Influx: influxConfig{Host: influx.URL}}.influxDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Couch.Host = couch.URL
+	config.devices = newFakeTTN()
+	config.Health = healthConfig{WarnLatency: "20ms", DegradedLatency: "50ms", Timeout: "100ms"}
+
+	get := func(config runtimeConfig, path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		setupRouter(config).ServeHTTP(w, req)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	services := func(body map[string]interface{}) map[string]map[string]interface{} {
+		byName := map[string]map[string]interface{}{}
+		list, _ := body["services"].([]interface{})
+		for _, s := range list {
+			service := s.(map[string]interface{})
+			byName[service["service"].(string)] = service
+		}
+		return byName
+	}
+
+	Convey("Subject: Dependency health checks", t, func() {
+		setCouch(0, http.StatusOK)
+
+		Convey("When every dependency answers quickly", func() {
+			code, body := get(config, "/status")
+			So(code, ShouldEqual, 200)
+			So(body["status"], ShouldEqual, statusOK)
+			So(services(body), ShouldContainKey, "couchDB")
+			So(services(body), ShouldContainKey, "influx")
+			So(services(body)["ttn"]["status"], ShouldEqual, statusOK)
+			So(body["messages"], ShouldBeEmpty)
+		})
+
+		Convey("When CouchDB is slower than the warning threshold", func() {
+			setCouch(30*time.Millisecond, http.StatusOK)
+			_, body := get(config, "/status")
+			So(services(body)["couchDB"]["status"], ShouldEqual, statusWarning)
+			So(services(body)["couchDB"]["latencyMs"], ShouldBeGreaterThanOrEqualTo, 30)
+			So(body["status"], ShouldEqual, statusWarning)
+		})
+
+		Convey("When CouchDB is slower than the degraded threshold", func() {
+			setCouch(60*time.Millisecond, http.StatusOK)
+			_, body := get(config, "/status")
+			So(body["status"], ShouldEqual, statusDegraded)
+		})
+
+		Convey("When CouchDB does not answer within the timeout", func() {
+			setCouch(150*time.Millisecond, http.StatusOK)
+			code, body := get(config, "/status")
+			So(code, ShouldEqual, 503)
+			So(services(body)["couchDB"]["status"], ShouldEqual, statusError)
+			So(body["status"], ShouldEqual, statusError)
+
+			Convey("Then the API is live but not ready", func() {
+				code, _ := get(config, "/healthz")
+				So(code, ShouldEqual, 200)
+				code, body := get(config, "/readyz")
+				So(code, ShouldEqual, 503)
+				So(services(body), ShouldNotContainKey, "ttn")
+			})
+		})
+
+		Convey("When CouchDB answers with an error status", func() {
+			setCouch(0, http.StatusInternalServerError)
+			_, body := get(config, "/status")
+			So(services(body)["couchDB"]["status"], ShouldEqual, statusError)
+			So(services(body)["couchDB"]["error"], ShouldContainSubstring, "500")
+		})
+
+		Convey("When the TTN handler is unreachable", func() {
+			down := config
+			down.devices = unreachableTTN{newFakeTTN()}
+			code, body := get(down, "/status")
+			So(code, ShouldEqual, 200)
+			So(services(body)["ttn"]["status"], ShouldEqual, statusError)
+			So(body["status"], ShouldEqual, statusDegraded)
+
+			Convey("Then the API is still ready", func() {
+				code, _ := get(down, "/readyz")
+				So(code, ShouldEqual, 200)
+			})
+		})
+
+		Convey("When the TTN handler stops answering", func() {
+			var calls int32
+			stalled := config
+			stalled.devices = stalledTTN{newFakeTTN(), &calls, make(chan struct{})}
+			defer close(stalled.devices.(stalledTTN).release)
+
+			start := time.Now()
+			err := stalled.pingTTN(20 * time.Millisecond)
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+
+			Convey("Then GET /status probes it once for many callers", func() {
+				atomic.StoreInt32(&calls, 0)
+				router := setupRouter(stalled)
+				for i := 0; i < 3; i++ {
+					w := httptest.NewRecorder()
+					req, _ := http.NewRequest("GET", "/status", nil)
+					router.ServeHTTP(w, req)
+					So(w.Code, ShouldEqual, 200)
+				}
+				So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the in-memory store is used", func() {
+			memory, _ := newMemoryTestConfig()
+			memory.devices = newFakeTTN()
+			code, body := get(memory, "/readyz")
+			So(code, ShouldEqual, 200)
+			So(services(body), ShouldContainKey, "memoryStore")
+		})
+	})
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// couchView - The shape of a CouchDB view response queried with include_docs
+type couchView struct {
+	TotalRows int `json:"total_rows"`
+	Offset    int `json:"offset"`
+	Rows      []struct {
+		ID    string          `json:"id"`
+		Key   json.RawMessage `json:"key"`
+		Value interface{}     `json:"value"`
+		Doc   json.RawMessage `json:"doc"`
+	} `json:"rows"`
+}
+
+// view queries a CouchDB view and returns its rows
+func (c couchConfig) view(ctx context.Context, path string) (view couchView, err error) {
+	code, resp, err := c.query(ctx, path)
+	if err != nil {
+		return view, err
+	}
+	if code != 200 {
+		return view, fmt.Errorf("couchdb: unexpected status %d from %s", code, path)
+	}
+	err = json.Unmarshal(resp, &view)
+	return view, err
+}
+
+// pagedView queries a page of a CouchDB view. One extra row is fetched to find
+// where the next page starts.
+func (c couchConfig) pagedView(ctx context.Context, path string, p pageRequest) (view couchView, next pageCursor, err error) {
+	if p.Limit > 0 {
+		path += "&limit=" + strconv.Itoa(p.Limit+1)
+	}
+	if len(p.Cursor.Key) > 0 {
+		path += "&startkey=" + url.QueryEscape(string(p.Cursor.Key)) + "&startkey_docid=" + url.QueryEscape(p.Cursor.DocID)
+	}
+	if view, err = c.view(ctx, path); err != nil {
+		return view, next, err
+	}
+	if p.Limit > 0 && len(view.Rows) > p.Limit {
+		first := view.Rows[p.Limit]
+		next = pageCursor{Key: first.Key, DocID: first.ID}
+		view.Rows = view.Rows[:p.Limit]
+	}
+	return view, next, nil
+}
+
+// document fetches a single document by ID into doc
+func (c couchConfig) document(ctx context.Context, id string, doc interface{}) error {
+	code, resp, err := c.query(ctx, "/kentnetwork/"+url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+	if code == 404 {
+		return errNotFound
+	}
+	if code != 200 {
+		return fmt.Errorf("couchdb: unexpected status %d fetching %s", code, id)
+	}
+	return json.Unmarshal(resp, doc)
+}
+
+// updateDocument reads a document, applies update and writes it back, retrying
+// when CouchDB reports the revision changed underneath us
+func (c couchConfig) updateDocument(ctx context.Context, id string, update func(doc map[string]json.RawMessage) error) (map[string]json.RawMessage, error) {
+	path := "/kentnetwork/" + url.PathEscape(id)
+	for attempt := 0; attempt < 3; attempt++ {
+		code, resp, err := c.query(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if code == 404 {
+			return nil, errNotFound
+		}
+		if code != 200 {
+			return nil, fmt.Errorf("couchdb: unexpected status %d fetching %s", code, id)
+		}
+
+		var doc map[string]json.RawMessage
+		if err = json.Unmarshal(resp, &doc); err != nil {
+			return nil, err
+		}
+		if err = update(doc); err != nil {
+			return nil, err
+		}
+
+		code, _, err = c.put(ctx, path, doc)
+		if err != nil {
+			return nil, err
+		}
+		if code == 409 {
+			continue
+		}
+		if code != 200 && code != 201 {
+			return nil, fmt.Errorf("couchdb: unexpected status %d updating %s", code, id)
+		}
+		return doc, nil
+	}
+	return nil, errConflict
+}
+
+// filteredView reads a page of a view, passing each document to keep which
+// decodes it and reports whether it matched. The view cannot filter, so when
+// filtering it is read in batches until the page is full. It returns how many
+// of the kept documents belong on the page.
+func (c couchConfig) filteredView(ctx context.Context, path string, filtering bool, p pageRequest, keep func(doc json.RawMessage) (bool, error)) (n int, next pageCursor, err error) {
+	var cursors []pageCursor // Where each kept document sits in the view
+	batch := pageRequest{Limit: p.Limit, Cursor: p.Cursor}
+	if p.Limit > 0 && filtering {
+		batch.Limit = maxResultLimit
+	}
+
+	for {
+		view, batchNext, err := c.pagedView(ctx, path, batch)
+		if err != nil {
+			return 0, next, err
+		}
+		for i := range view.Rows {
+			kept, err := keep(view.Rows[i].Doc)
+			if err != nil {
+				return 0, next, err
+			}
+			if kept {
+				cursors = append(cursors, pageCursor{Key: view.Rows[i].Key, DocID: view.Rows[i].ID})
+			}
+		}
+
+		if p.Limit > 0 && len(cursors) > p.Limit {
+			return p.Limit, cursors[p.Limit], nil
+		}
+		if batchNext.isZero() {
+			return len(cursors), next, nil
+		}
+		if p.Limit > 0 && len(cursors) == p.Limit {
+			// The page is full but more rows remain, resume there
+			return len(cursors), batchNext, nil
+		}
+		batch.Cursor = batchNext
+	}
+}
+
+// Devices returns a page of device documents matching the filter
+func (c couchConfig) Devices(ctx context.Context, f deviceFilter, p pageRequest) (devices []device, next pageCursor, err error) {
+	n, next, err := c.filteredView(ctx, "/kentnetwork/_design/devices/_view/getDevices?include_docs=true", !f.isZero(), p, func(doc json.RawMessage) (bool, error) {
+		var d device
+		if err := json.Unmarshal(doc, &d); err != nil || !f.match(d) {
+			return false, err
+		}
+		devices = append(devices, d)
+		return true, nil
+	})
+	if err != nil {
+		return nil, next, err
+	}
+	return devices[:n], next, nil
+}
+
+// Device returns a single device document, other documents are not found
+func (c couchConfig) Device(ctx context.Context, deviceID string) (d device, err error) {
+	if !isDeviceID(deviceID) {
+		return d, errNotFound
+	}
+	err = c.document(ctx, deviceID, &d)
+	return d, err
+}
+
+// Sensors returns a page of sensor documents matching the filter
+func (c couchConfig) Sensors(ctx context.Context, f sensorFilter, p pageRequest) (sensors []sensor, next pageCursor, err error) {
+	n, next, err := c.filteredView(ctx, "/kentnetwork/_design/sensors/_view/getSensors?include_docs=true", !f.isZero(), p, func(doc json.RawMessage) (bool, error) {
+		var s sensor
+		if err := json.Unmarshal(doc, &s); err != nil || !f.match(s) {
+			return false, err
+		}
+		sensors = append(sensors, s)
+		return true, nil
+	})
+	if err != nil {
+		return nil, next, err
+	}
+	return sensors[:n], next, nil
+}
+
+// Sensor returns a single sensor document, other documents are not found
+func (c couchConfig) Sensor(ctx context.Context, sensorID string) (s sensor, err error) {
+	if !isSensorID(sensorID) {
+		return s, errNotFound
+	}
+	err = c.document(ctx, sensorID, &s)
+	return s, err
+}
+
+// DeviceSensors returns the sensors attached to a device
+func (c couchConfig) DeviceSensors(ctx context.Context, deviceID string) ([]sensor, error) {
+	return c.sensorView(ctx, "/kentnetwork/_design/sensors/_view/getByDeviceID?include_docs=true&startkey="+
+		url.QueryEscape("\""+deviceID+"\"")+"&endkey="+url.QueryEscape("\""+deviceID+"\ufff0\""))
+}
+
+// VisibleDeviceIDs returns the IDs of the devices owned by the organisation or
+// public. The devices design document's getByOwner view emits each device's
+// owner, and true as well for public devices:
+//
+//	function (doc) {
+//	  if (doc._id.indexOf("device:") === 0 && doc._id.indexOf(":sensorid:") < 0) {
+//	    emit(doc.owner || null, null);
+//	    if (doc.public) emit(true, null);
+//	  }
+//	}
+func (c couchConfig) VisibleDeviceIDs(ctx context.Context, org string) (ids []string, err error) {
+	keys, _ := json.Marshal([]interface{}{org, true})
+	view, err := c.view(ctx, "/kentnetwork/_design/devices/_view/getByOwner?keys="+url.QueryEscape(string(keys)))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i := range view.Rows {
+		if id := view.Rows[i].ID; !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// DeviceByTTNDevID returns the device registered with TTN under the dev_id.
+// The devices design document's getByTTNDevID view emits each device's dev_id:
+//
+//	function (doc) {
+//	  if (doc._id.indexOf("device:") === 0 && doc._id.indexOf(":sensorid:") < 0 && doc.ttn && doc.ttn.devId) {
+//	    emit(doc.ttn.devId, null);
+//	  }
+//	}
+func (c couchConfig) DeviceByTTNDevID(ctx context.Context, devID string) (d device, err error) {
+	key, _ := json.Marshal(devID)
+	view, err := c.view(ctx, "/kentnetwork/_design/devices/_view/getByTTNDevID?include_docs=true&limit=1&key="+url.QueryEscape(string(key)))
+	if err != nil {
+		return d, err
+	}
+	if len(view.Rows) == 0 {
+		return d, errNotFound
+	}
+	err = json.Unmarshal(view.Rows[0].Doc, &d)
+	return d, err
+}
+
+func (c couchConfig) sensorView(ctx context.Context, path string) (sensors []sensor, err error) {
+	view, err := c.view(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return sensorsFromView(view)
+}
+
+func sensorsFromView(view couchView) (sensors []sensor, err error) {
+	for i := range view.Rows {
+		var s sensor
+		if err = json.Unmarshal(view.Rows[i].Doc, &s); err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors, nil
+}
+
+// createDocument writes a new document, failing with errConflict if the ID is taken
+func (c couchConfig) createDocument(ctx context.Context, id string, doc interface{}) error {
+	code, _, err := c.put(ctx, "/kentnetwork/"+url.PathEscape(id), doc)
+	if err != nil {
+		return err
+	}
+	if code == 409 {
+		return errConflict
+	}
+	if code != 200 && code != 201 {
+		return fmt.Errorf("couchdb: unexpected status %d creating %s", code, id)
+	}
+	return nil
+}
+
+// removeDocument deletes the current revision of a document
+func (c couchConfig) removeDocument(ctx context.Context, id string) error {
+	var doc struct {
+		Rev string `json:"_rev"`
+	}
+	if err := c.document(ctx, id, &doc); err != nil {
+		return err
+	}
+	code, _, err := c.delete(ctx, "/kentnetwork/"+url.PathEscape(id)+"?rev="+url.QueryEscape(doc.Rev))
+	if err != nil {
+		return err
+	}
+	if code == 404 {
+		return errNotFound
+	}
+	if code == 409 {
+		return errConflict
+	}
+	if code != 200 && code != 202 {
+		return fmt.Errorf("couchdb: unexpected status %d deleting %s", code, id)
+	}
+	return nil
+}
+
+// CreateDevice writes a new device document, failing with errConflict if the ID is taken
+func (c couchConfig) CreateDevice(ctx context.Context, d device) (device, error) {
+	return d, c.createDocument(ctx, d.ID, d)
+}
+
+// UpdateDevice applies a patch to a device document, leaving fields the API
+// does not model untouched
+func (c couchConfig) UpdateDevice(ctx context.Context, deviceID string, patch devicePatch) (d device, err error) {
+	if !isDeviceID(deviceID) {
+		return d, errNotFound
+	}
+	doc, err := c.updateDocument(ctx, deviceID, func(doc map[string]json.RawMessage) error {
+		if patch.Location != nil {
+			doc["location"], _ = json.Marshal(patch.Location)
+		}
+		if patch.HardwareRef != nil {
+			doc["hardwareRef"], _ = json.Marshal(patch.HardwareRef)
+		}
+		if patch.BatteryType != nil {
+			doc["batteryType"], _ = json.Marshal(patch.BatteryType)
+		}
+		if patch.Owner != nil {
+			doc["owner"], _ = json.Marshal(patch.Owner)
+		}
+		if patch.Public != nil {
+			doc["public"], _ = json.Marshal(patch.Public)
+		}
+		return nil
+	})
+	if err != nil {
+		return d, err
+	}
+
+	data, _ := json.Marshal(doc)
+	err = json.Unmarshal(data, &d)
+	return d, err
+}
+
+// CreateSensor writes a new sensor document, failing with errConflict if the ID is taken
+func (c couchConfig) CreateSensor(ctx context.Context, s sensor) (sensor, error) {
+	return s, c.createDocument(ctx, s.ID, s)
+}
+
+// NextSensorNumber hands out the next sensor number of a device, above after
+// and every number handed out before. The last number is kept on the device
+// document as lastSensorNumber.
+func (c couchConfig) NextSensorNumber(ctx context.Context, deviceID string, after int) (n int, err error) {
+	if !isDeviceID(deviceID) {
+		return 0, errNotFound
+	}
+	_, err = c.updateDocument(ctx, deviceID, func(doc map[string]json.RawMessage) error {
+		var last int
+		if raw, ok := doc["lastSensorNumber"]; ok {
+			if err := json.Unmarshal(raw, &last); err != nil {
+				return err
+			}
+		}
+		n = after + 1
+		if last >= n {
+			n = last + 1
+		}
+		doc["lastSensorNumber"], _ = json.Marshal(n)
+		return nil
+	})
+	return n, err
+}
+
+// UpdateSensor applies a patch to a sensor document if the result is still valid
+func (c couchConfig) UpdateSensor(ctx context.Context, sensorID string, patch sensorPatch) (s sensor, err error) {
+	if !isSensorID(sensorID) {
+		return s, errNotFound
+	}
+	_, err = c.updateDocument(ctx, sensorID, func(doc map[string]json.RawMessage) error {
+		data, _ := json.Marshal(doc)
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		patch.apply(&s)
+		if err := validSensor(s); err != nil {
+			return err
+		}
+
+		doc["updateInterval"], _ = json.Marshal(s.UpdateInterval)
+		doc["sensorType"], _ = json.Marshal(s.SensorType)
+		doc["unit"], _ = json.Marshal(s.Unit)
+		return nil
+	})
+	return s, err
+}
+
+// RemoveSensor deletes a sensor document, its readings are kept
+func (c couchConfig) RemoveSensor(ctx context.Context, sensorID string) error {
+	if !isSensorID(sensorID) {
+		return errNotFound
+	}
+	return c.removeDocument(ctx, sensorID)
+}
+
+// APIKeys returns every API key document. They are found by their ID prefix
+// so no design document is needed.
+func (c couchConfig) APIKeys(ctx context.Context) (keys []apiKey, err error) {
+	view, err := c.view(ctx, "/kentnetwork/_all_docs?include_docs=true&startkey="+
+		url.QueryEscape(`"`+apiKeyIDPrefix+`"`)+"&endkey="+url.QueryEscape("\""+apiKeyIDPrefix+"\ufff0\""))
+	if err != nil {
+		return nil, err
+	}
+	for i := range view.Rows {
+		var k apiKey
+		if err = json.Unmarshal(view.Rows[i].Doc, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// APIKey fetches a single API key document by ID
+func (c couchConfig) APIKey(ctx context.Context, keyID string) (k apiKey, err error) {
+	if !isAPIKeyID(keyID) {
+		return k, errNotFound
+	}
+	err = c.document(ctx, keyID, &k)
+	return k, err
+}
+
+// CreateAPIKey writes a new API key document, failing with errConflict if the ID is taken
+func (c couchConfig) CreateAPIKey(ctx context.Context, k apiKey) (apiKey, error) {
+	return k, c.createDocument(ctx, k.ID, k)
+}
+
+// TouchAPIKey records when an API key was last used
+func (c couchConfig) TouchAPIKey(ctx context.Context, keyID string, used time.Time) error {
+	_, err := c.updateDocument(ctx, keyID, func(doc map[string]json.RawMessage) error {
+		doc["lastUsed"], _ = json.Marshal(used.UTC().Format(dateTimeLayout))
+		return nil
+	})
+	return err
+}
+
+// RemoveAPIKey deletes an API key document, other documents are not found
+func (c couchConfig) RemoveAPIKey(ctx context.Context, keyID string) error {
+	if !isAPIKeyID(keyID) {
+		return errNotFound
+	}
+	return c.removeDocument(ctx, keyID)
+}
+
+// GatewayOwners returns the ownership documents of registered gateways keyed by
+// gateway MAC. They are stored as "gateway:<mac>".
+func (c couchConfig) GatewayOwners(ctx context.Context) (map[string]ownership, error) {
+	view, err := c.view(ctx, "/kentnetwork/_all_docs?include_docs=true&startkey="+
+		url.QueryEscape(`"gateway:"`)+"&endkey="+url.QueryEscape("\"gateway:\ufff0\""))
+	if err != nil {
+		return nil, err
+	}
+	owners := map[string]ownership{}
+	for i := range view.Rows {
+		var o ownership
+		if err = json.Unmarshal(view.Rows[i].Doc, &o); err != nil {
+			return nil, err
+		}
+		owners[strings.TrimPrefix(view.Rows[i].ID, "gateway:")] = o
+	}
+	return owners, nil
+}
+
+// ServiceMessages returns every announcement document, newest first. They are
+// found by their ID prefix so no design document is needed.
+func (c couchConfig) ServiceMessages(ctx context.Context) (messages []serviceMessage, err error) {
+	view, err := c.view(ctx, "/kentnetwork/_all_docs?include_docs=true&startkey="+
+		url.QueryEscape(`"`+announcementIDPrefix+`"`)+"&endkey="+url.QueryEscape("\""+announcementIDPrefix+"\ufff0\""))
+	if err != nil {
+		return nil, err
+	}
+	for i := range view.Rows {
+		var m serviceMessage
+		if err = json.Unmarshal(view.Rows[i].Doc, &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return newestMessagesFirst(messages), nil
+}
+
+// CreateServiceMessage writes a new announcement document, failing with errConflict if the ID is taken
+func (c couchConfig) CreateServiceMessage(ctx context.Context, m serviceMessage) (serviceMessage, error) {
+	return m, c.createDocument(ctx, m.ID, m)
+}
+
+// UpdateServiceMessage applies a patch to an announcement document if the
+// result is still valid, other documents are not found
+func (c couchConfig) UpdateServiceMessage(ctx context.Context, messageID string, patch announcementPatch, updated time.Time) (m serviceMessage, err error) {
+	if !isAnnouncementID(messageID) {
+		return m, errNotFound
+	}
+	_, err = c.updateDocument(ctx, messageID, func(doc map[string]json.RawMessage) error {
+		data, _ := json.Marshal(doc)
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		patch.apply(&m)
+		m.LastUpdated = updated
+		if err := validAnnouncement(m); err != nil {
+			return err
+		}
+
+		// Re-encode the message so cleared optional fields are dropped, keeping the revision
+		rev := doc["_rev"]
+		data, _ = json.Marshal(m)
+		for k := range doc {
+			delete(doc, k)
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		doc["_id"], _ = json.Marshal(messageID)
+		doc["_rev"] = rev
+		return nil
+	})
+	return m, err
+}
+
+// StatusEvents returns the status history stored on a device document, newest first
+func (c couchConfig) StatusEvents(ctx context.Context, deviceID string) ([]status, error) {
+	if !isDeviceID(deviceID) {
+		return nil, errNotFound
+	}
+	var doc struct {
+		StatusHistory []status `json:"statusHistory"`
+	}
+	if err := c.document(ctx, deviceID, &doc); err != nil {
+		return nil, err
+	}
+	return newestFirst(doc.StatusHistory), nil
+}
+
+// AddStatusEvent appends to the device's status history and makes the event its current status
+func (c couchConfig) AddStatusEvent(ctx context.Context, deviceID string, event status) (d device, err error) {
+	if !isDeviceID(deviceID) {
+		return d, errNotFound
+	}
+	doc, err := c.updateDocument(ctx, deviceID, func(doc map[string]json.RawMessage) error {
+		var current *status
+		var history []status
+		if raw, ok := doc["status"]; ok {
+			if err := json.Unmarshal(raw, &current); err != nil {
+				return err
+			}
+		}
+		if raw, ok := doc["statusHistory"]; ok {
+			if err := json.Unmarshal(raw, &history); err != nil {
+				return err
+			}
+		}
+
+		from := Unseen
+		if current != nil {
+			from = current.Type
+		}
+		if err := validTransition(from, event.Type); err != nil {
+			return err
+		}
+
+		doc["status"], _ = json.Marshal(event)
+		doc["statusHistory"], _ = json.Marshal(append(history, event))
+		return nil
+	})
+	if err != nil {
+		return d, err
+	}
+
+	data, _ := json.Marshal(doc)
+	err = json.Unmarshal(data, &d)
+	return d, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// gatewayDb - The database gateway statistics and uplink metadata are kept in
+const gatewayDb = "gatewayrxpkts"
+
+// SensorReadings returns the readings of a sensor from the configured database
+func (c influxConfig) SensorReadings(ctx context.Context, sensorID string, q readingQuery) ([]reading, error) {
+	return getSensorData(ctx, c, sensorID, q, c.Db)
+}
+
+// WriteReadings stores readings as a single batch, each in a measurement named
+// after its sensor type and tagged with the sensor_id readings are queried by
+func (c influxConfig) WriteReadings(ctx context.Context, points []readingPoint) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: c.Db, Precision: "ms"})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		t, err := time.Parse(time.RFC3339Nano, p.DateTime)
+		if err != nil {
+			return err
+		}
+		tags := map[string]string{"sensor_id": p.Sensor, "unit": p.Unit, "source": p.Source}
+		pt, err := client.NewPoint(p.SensorType, tags, map[string]interface{}{"value": p.Value}, t)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	return c.writeInfluxDB(ctx, bp)
+}
+
+// WriteGatewayReceptions stores the uplink metadata of gateways in the gateway
+// packet database, tagged with the gateway and the device heard
+func (c influxConfig) WriteGatewayReceptions(ctx context.Context, receptions []gatewayReception) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: gatewayDb, Precision: "ms"})
+	if err != nil {
+		return err
+	}
+	for _, r := range receptions {
+		fields := map[string]interface{}{
+			"rssi":      r.RSSI,
+			"snr":       r.SNR,
+			"channel":   int64(r.Channel),
+			"frequency": r.Frequency,
+		}
+		if r.Lat != 0 || r.Lon != 0 {
+			fields["lat"], fields["lon"], fields["alt"] = r.Lat, r.Lon, r.Altitude
+		}
+		tags := map[string]string{"gatewayMac": r.GatewayMac, "device_id": r.Device}
+		pt, err := client.NewPoint("rxpk", tags, fields, r.Time)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	return c.writeInfluxDB(ctx, bp)
+}
+
+// Gateways returns the last known position of every gateway
+func (c influxConfig) Gateways(ctx context.Context) ([]gateway, error) {
+	return getGatewaysMeta(ctx, c, gatewayDb)
+}
+
+// sensorReadingsQuery builds the InfluxQL statement for a sensor's readings
+func sensorReadingsQuery(sensorID string, rq readingQuery) string {
+	q := newInfluxQuery(influxField("", "value", ""))
+	if rq.Latest {
+		q = newInfluxQuery(influxField("last", "value", ""))
+	} else if rq.Aggregate != "" {
+		q = newInfluxQuery(influxField(rq.Aggregate, "value", "value"))
+	}
+	q.FromRegex(".*").WhereTag("sensor_id", sensorID)
+	if !rq.Latest && !rq.StartDate.IsZero() && !rq.EndDate.IsZero() {
+		q.WhereTime(">=", rq.StartDate).WhereTime("<=", rq.EndDate)
+	}
+	if !rq.Before.IsZero() && rq.Aggregate != "" {
+		// Before is the start of a bucket, so keep every reading that falls in it
+		q.WhereTime("<", rq.Before.Add(rq.Interval))
+	} else if !rq.Before.IsZero() {
+		q.WhereTime("<=", rq.Before)
+	}
+	if rq.Aggregate != "" {
+		q.GroupByTime(rq.Interval).Fill(rq.Fill)
+	}
+	limit := rq.Limit
+	if limit == 0 {
+		limit = resultLimit
+	}
+	return q.OrderByTimeDesc().Limit(limit).String()
+}
+
+func getSensorData(ctx context.Context, influx influxConfig, sensorID string, rq readingQuery, influxDb string) (readings []reading, err error) {
+	q := sensorReadingsQuery(sensorID, rq)
+	var response []client.Result
+	if response, err = influx.queryInfluxDB(ctx, q, influxDb); err == nil {
+		if len(response) == 0 || response[0].Series == nil {
+			return nil, nil
+		}
+
+		for i := range response[0].Series[0].Values {
+			// Aggregated buckets without data come back as null
+			v, ok := response[0].Series[0].Values[i][1].(json.Number)
+			if !ok {
+				continue
+			}
+			s, sErr := v.Float64()
+			t, tErr := time.Parse(time.RFC3339, response[0].Series[0].Values[i][0].(string))
+			if sErr == nil && tErr == nil {
+				var k reading
+				k.Sensor = sensorID
+				k.DateTime = t.Format("2006-01-02T15:04:05.999Z07:00")
+				k.Value = s
+				readings = append(readings, k)
+			}
+		}
+		return readings, nil
+	}
+	return readings, err
+}
+
+func getGatewaysMeta(ctx context.Context, influx influxConfig, influxDb string) (gateways []gateway, err error) {
+	q := newInfluxQuery(influxField("last", "lat", "lat"), influxField("", "lon", "")).
+		From("stat").
+		GroupBy("gatewayMac").
+		String()
+
+	var response []client.Result
+	if response, err = influx.queryInfluxDB(ctx, q, influxDb); err == nil {
+		if len(response) == 0 || response[0].Series == nil {
+			return nil, nil
+		}
+
+		for i := range response[0].Series {
+			r := response[0].Series[i].Tags["gatewayMac"]
+			s, sErr := response[0].Series[i].Values[0][1].(json.Number).Float64()
+			t, tErr := response[0].Series[i].Values[0][2].(json.Number).Float64()
+			if sErr == nil && tErr == nil {
+				var k gateway
+				k.GatewayMac = r
+				k.Lat = s
+				k.Lon = t
+				gateways = append(gateways, k)
+			}
+		}
+		return gateways, nil
+	}
+	return gateways, err
+}
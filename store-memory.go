@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore - An in-memory MetadataStore and ReadingStore for tests and local development
+type memoryStore struct {
+	mu         sync.RWMutex
+	devices    map[string]device
+	sensors    map[string]sensor
+	readings   map[string][]reading // Keyed by sensor ID, oldest first
+	gateways   []gateway
+	receptions []gatewayReception  // Gateway uplink metadata, oldest first
+	history    map[string][]status // Status events keyed by device ID, oldest first
+	apiKeys    map[string]apiKey
+	owners     map[string]ownership // Gateway ownership keyed by gateway MAC
+	messages   map[string]serviceMessage
+	numbers    map[string]int // Last sensor number handed out, keyed by device ID
+}
+
+// memorySeed - The layout of a JSON file used to pre-populate a memoryStore
+type memorySeed struct {
+	Devices  []device  `json:"devices"`
+	Sensors  []sensor  `json:"sensors"`
+	Readings []reading `json:"readings"`
+	Gateways []gateway `json:"gateways"`
+
+	GatewayOwners map[string]ownership `json:"gatewayOwners"`
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		devices:  map[string]device{},
+		sensors:  map[string]sensor{},
+		readings: map[string][]reading{},
+		history:  map[string][]status{},
+		apiKeys:  map[string]apiKey{},
+		owners:   map[string]ownership{},
+		messages: map[string]serviceMessage{},
+		numbers:  map[string]int{},
+	}
+}
+
+// memoryStoreFromFile builds a memoryStore seeded from a JSON file
+func memoryStoreFromFile(path string) (*memoryStore, error) {
+	m := newMemoryStore()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var seed memorySeed
+	if err = json.Unmarshal(data, &seed); err != nil {
+		return nil, err
+	}
+	for _, d := range seed.Devices {
+		m.addDevice(d)
+	}
+	for _, s := range seed.Sensors {
+		m.addSensor(s)
+	}
+	m.addReadings(seed.Readings...)
+	m.gateways = append(m.gateways, seed.Gateways...)
+	for mac, o := range seed.GatewayOwners {
+		m.owners[mac] = o
+	}
+	return m, nil
+}
+
+func (m *memoryStore) addDevice(d device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices[d.ID] = d
+}
+
+func (m *memoryStore) addSensor(s sensor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sensors[s.ID] = s
+}
+
+func (m *memoryStore) addReadings(readings ...reading) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range readings {
+		m.readings[r.Sensor] = append(m.readings[r.Sensor], r)
+	}
+	for id := range m.readings {
+		list := m.readings[id]
+		sort.SliceStable(list, func(i, j int) bool {
+			return readingTime(list[i]).Before(readingTime(list[j]))
+		})
+	}
+}
+
+// Devices returns a page of devices matching the filter ordered by ID
+func (m *memoryStore) Devices(ctx context.Context, f deviceFilter, p pageRequest) ([]device, pageCursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var devices []device
+	for _, d := range m.devices {
+		if d.ID >= p.Cursor.DocID && f.match(d) {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	var next pageCursor
+	if p.Limit > 0 && len(devices) > p.Limit {
+		next = pageCursor{DocID: devices[p.Limit].ID}
+		devices = devices[:p.Limit]
+	}
+	return devices, next, nil
+}
+
+// Device returns a single device
+func (m *memoryStore) Device(ctx context.Context, deviceID string) (device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.devices[deviceID]
+	if !ok {
+		return d, errNotFound
+	}
+	return d, nil
+}
+
+// VisibleDeviceIDs returns the IDs of the devices owned by the organisation or public
+func (m *memoryStore) VisibleDeviceIDs(ctx context.Context, org string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ids []string
+	for id, d := range m.devices {
+		if d.Owner == org || d.Public {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// DeviceByTTNDevID returns the device registered with TTN under the dev_id
+func (m *memoryStore) DeviceByTTNDevID(ctx context.Context, devID string) (device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, d := range m.devices {
+		if d.Ttn != nil && d.Ttn.DevID == devID {
+			return d, nil
+		}
+	}
+	return device{}, errNotFound
+}
+
+// Sensors returns a page of sensors ordered by ID
+func (m *memoryStore) Sensors(ctx context.Context, f sensorFilter, p pageRequest) ([]sensor, pageCursor, error) {
+	sensors := m.filterSensors(func(s sensor) bool { return s.ID >= p.Cursor.DocID && f.match(s) })
+
+	var next pageCursor
+	if p.Limit > 0 && len(sensors) > p.Limit {
+		next = pageCursor{DocID: sensors[p.Limit].ID}
+		sensors = sensors[:p.Limit]
+	}
+	return sensors, next, nil
+}
+
+// Sensor returns a single sensor
+func (m *memoryStore) Sensor(ctx context.Context, sensorID string) (sensor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sensors[sensorID]
+	if !ok {
+		return s, errNotFound
+	}
+	return s, nil
+}
+
+// DeviceSensors returns the sensors attached to a device ordered by ID
+func (m *memoryStore) DeviceSensors(ctx context.Context, deviceID string) ([]sensor, error) {
+	return m.filterSensors(func(s sensor) bool { return s.ParentDevice == deviceID }), nil
+}
+
+func (m *memoryStore) filterSensors(keep func(sensor) bool) []sensor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var sensors []sensor
+	for _, s := range m.sensors {
+		if keep(s) {
+			sensors = append(sensors, s)
+		}
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].ID < sensors[j].ID })
+	return sensors
+}
+
+// CreateDevice adds a new device, failing with errConflict if the ID is taken
+func (m *memoryStore) CreateDevice(ctx context.Context, d device) (device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.devices[d.ID]; ok {
+		return d, errConflict
+	}
+	m.devices[d.ID] = d
+	return d, nil
+}
+
+// UpdateDevice applies a patch to a stored device
+func (m *memoryStore) UpdateDevice(ctx context.Context, deviceID string, patch devicePatch) (device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[deviceID]
+	if !ok {
+		return d, errNotFound
+	}
+	patch.apply(&d)
+	m.devices[deviceID] = d
+	return d, nil
+}
+
+// CreateSensor adds a new sensor, failing with errConflict if the ID is taken
+func (m *memoryStore) CreateSensor(ctx context.Context, s sensor) (sensor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sensors[s.ID]; ok {
+		return s, errConflict
+	}
+	m.sensors[s.ID] = s
+	return s, nil
+}
+
+// NextSensorNumber hands out the next sensor number of a device, above after
+// and every number handed out before. Numbers outlive the device.
+func (m *memoryStore) NextSensorNumber(ctx context.Context, deviceID string, after int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.devices[deviceID]; !ok {
+		return 0, errNotFound
+	}
+	if m.numbers[deviceID] > after {
+		after = m.numbers[deviceID]
+	}
+	m.numbers[deviceID] = after + 1
+	return after + 1, nil
+}
+
+// UpdateSensor applies a patch to a stored sensor if the result is still valid
+func (m *memoryStore) UpdateSensor(ctx context.Context, sensorID string, patch sensorPatch) (sensor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sensors[sensorID]
+	if !ok {
+		return s, errNotFound
+	}
+	patch.apply(&s)
+	if err := validSensor(s); err != nil {
+		return s, err
+	}
+	m.sensors[sensorID] = s
+	return s, nil
+}
+
+// RemoveSensor deletes a sensor, its readings are kept
+func (m *memoryStore) RemoveSensor(ctx context.Context, sensorID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sensors[sensorID]; !ok {
+		return errNotFound
+	}
+	delete(m.sensors, sensorID)
+	return nil
+}
+
+// StatusEvents returns the status history of a device newest first
+func (m *memoryStore) StatusEvents(ctx context.Context, deviceID string) ([]status, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, errNotFound
+	}
+	return newestFirst(m.history[deviceID]), nil
+}
+
+// AddStatusEvent appends to the device's status history and makes the event its current status
+func (m *memoryStore) AddStatusEvent(ctx context.Context, deviceID string, event status) (device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[deviceID]
+	if !ok {
+		return d, errNotFound
+	}
+
+	from := Unseen
+	if d.Status != nil {
+		from = d.Status.Type
+	}
+	if err := validTransition(from, event.Type); err != nil {
+		return d, err
+	}
+
+	d.Status = &event
+	m.devices[deviceID] = d
+	m.history[deviceID] = append(m.history[deviceID], event)
+	return d, nil
+}
+
+// APIKeys returns every API key ordered by ID
+func (m *memoryStore) APIKeys(ctx context.Context) ([]apiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]apiKey, 0, len(m.apiKeys))
+	for _, k := range m.apiKeys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+// APIKey returns a single API key by ID
+func (m *memoryStore) APIKey(ctx context.Context, keyID string) (apiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.apiKeys[keyID]
+	if !ok {
+		return k, errNotFound
+	}
+	return k, nil
+}
+
+// CreateAPIKey adds a new API key, failing with errConflict if the ID is taken
+func (m *memoryStore) CreateAPIKey(ctx context.Context, k apiKey) (apiKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.apiKeys[k.ID]; ok {
+		return k, errConflict
+	}
+	m.apiKeys[k.ID] = k
+	return k, nil
+}
+
+// TouchAPIKey records when an API key was last used
+func (m *memoryStore) TouchAPIKey(ctx context.Context, keyID string, used time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[keyID]
+	if !ok {
+		return errNotFound
+	}
+	k.LastUsed = used.UTC().Format(dateTimeLayout)
+	m.apiKeys[keyID] = k
+	return nil
+}
+
+// RemoveAPIKey revokes an API key
+func (m *memoryStore) RemoveAPIKey(ctx context.Context, keyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.apiKeys[keyID]; !ok {
+		return errNotFound
+	}
+	delete(m.apiKeys, keyID)
+	return nil
+}
+
+// GatewayOwners returns the ownership of registered gateways keyed by gateway MAC
+func (m *memoryStore) GatewayOwners(ctx context.Context) (map[string]ownership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	owners := make(map[string]ownership, len(m.owners))
+	for mac, o := range m.owners {
+		owners[mac] = o
+	}
+	return owners, nil
+}
+
+// SensorReadings returns the readings of a sensor newest first, mirroring the InfluxDB queries
+func (m *memoryStore) SensorReadings(ctx context.Context, sensorID string, q readingQuery) ([]reading, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	limit := q.Limit
+	if limit == 0 {
+		limit = resultLimit
+	}
+
+	if q.Aggregate != "" {
+		return m.aggregatedReadings(sensorID, q, limit), nil
+	}
+
+	var readings []reading
+	list := m.readings[sensorID]
+	for i := len(list) - 1; i >= 0 && len(readings) < limit; i-- {
+		t := readingTime(list[i])
+		if !q.Latest && !q.StartDate.IsZero() && t.Before(q.StartDate) {
+			continue
+		}
+		if !q.Latest && !q.EndDate.IsZero() && t.After(q.EndDate) {
+			continue
+		}
+		if !q.Before.IsZero() && t.After(q.Before) {
+			continue
+		}
+		readings = append(readings, list[i])
+		if q.Latest {
+			break
+		}
+	}
+	return readings, nil
+}
+
+func (m *memoryStore) aggregatedReadings(sensorID string, q readingQuery, limit int) []reading {
+	var window []reading
+	for _, r := range m.readings[sensorID] {
+		t := readingTime(r)
+		if !t.Before(q.StartDate) && !t.After(q.EndDate) {
+			window = append(window, r)
+		}
+	}
+
+	var readings []reading
+	for _, r := range aggregateReadings(sensorID, window, q) {
+		if !q.Before.IsZero() && readingTime(r).After(q.Before) {
+			continue
+		}
+		if len(readings) == limit {
+			break
+		}
+		readings = append(readings, r)
+	}
+	return readings
+}
+
+// WriteReadings stores readings alongside those already held
+func (m *memoryStore) WriteReadings(ctx context.Context, points []readingPoint) error {
+	readings := make([]reading, len(points))
+	for i := range points {
+		readings[i] = points[i].reading
+	}
+	m.addReadings(readings...)
+	return nil
+}
+
+// WriteGatewayReceptions keeps the uplink metadata of gateways
+func (m *memoryStore) WriteGatewayReceptions(ctx context.Context, receptions []gatewayReception) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.receptions = append(m.receptions, receptions...)
+	return nil
+}
+
+// Gateways returns every gateway
+func (m *memoryStore) Gateways(ctx context.Context) ([]gateway, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]gateway(nil), m.gateways...), nil
+}
+
+// readingTime parses the timestamp of a reading, returning the zero time when malformed
+func readingTime(r reading) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, r.DateTime)
+	return t
+}
+
+// ServiceMessages returns every announcement, newest first
+func (m *memoryStore) ServiceMessages(ctx context.Context) ([]serviceMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	messages := make([]serviceMessage, 0, len(m.messages))
+	for _, msg := range m.messages {
+		messages = append(messages, msg)
+	}
+	return newestMessagesFirst(messages), nil
+}
+
+// CreateServiceMessage adds a new announcement, failing with errConflict if the ID is taken
+func (m *memoryStore) CreateServiceMessage(ctx context.Context, msg serviceMessage) (serviceMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.messages[msg.ID]; ok {
+		return msg, errConflict
+	}
+	m.messages[msg.ID] = msg
+	return msg, nil
+}
+
+// UpdateServiceMessage applies a patch to an announcement if the result is still valid
+func (m *memoryStore) UpdateServiceMessage(ctx context.Context, messageID string, patch announcementPatch, updated time.Time) (serviceMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return msg, errNotFound
+	}
+	patch.apply(&msg)
+	msg.LastUpdated = updated
+	if err := validAnnouncement(msg); err != nil {
+		return msg, err
+	}
+	m.messages[messageID] = msg
+	return msg, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// errNotFound is returned by a store when the requested document does not exist
+	errNotFound = errors.New("not found")
+	// errConflict is returned when a document kept changing while it was being updated,
+	// or already exists when it is created
+	errConflict = errors.New("document update conflict")
+)
+
+// MetadataStore - Backend holding the device and sensor documents
+type MetadataStore interface {
+	Devices(ctx context.Context, f deviceFilter, p pageRequest) ([]device, pageCursor, error)
+	Device(ctx context.Context, deviceID string) (device, error)
+	Sensors(ctx context.Context, f sensorFilter, p pageRequest) ([]sensor, pageCursor, error)
+	Sensor(ctx context.Context, sensorID string) (sensor, error)
+	DeviceSensors(ctx context.Context, deviceID string) ([]sensor, error)
+	VisibleDeviceIDs(ctx context.Context, org string) ([]string, error)
+	DeviceByTTNDevID(ctx context.Context, devID string) (device, error)
+
+	CreateDevice(ctx context.Context, d device) (device, error)
+	UpdateDevice(ctx context.Context, deviceID string, patch devicePatch) (device, error)
+
+	CreateSensor(ctx context.Context, s sensor) (sensor, error)
+	UpdateSensor(ctx context.Context, sensorID string, patch sensorPatch) (sensor, error)
+	RemoveSensor(ctx context.Context, sensorID string) error
+	NextSensorNumber(ctx context.Context, deviceID string, after int) (int, error)
+
+	StatusEvents(ctx context.Context, deviceID string) ([]status, error)
+	AddStatusEvent(ctx context.Context, deviceID string, event status) (device, error)
+
+	APIKeys(ctx context.Context) ([]apiKey, error)
+	APIKey(ctx context.Context, keyID string) (apiKey, error)
+	CreateAPIKey(ctx context.Context, k apiKey) (apiKey, error)
+	TouchAPIKey(ctx context.Context, keyID string, used time.Time) error
+	RemoveAPIKey(ctx context.Context, keyID string) error
+
+	GatewayOwners(ctx context.Context) (map[string]ownership, error)
+
+	ServiceMessages(ctx context.Context) ([]serviceMessage, error)
+	CreateServiceMessage(ctx context.Context, m serviceMessage) (serviceMessage, error)
+	UpdateServiceMessage(ctx context.Context, messageID string, patch announcementPatch, updated time.Time) (serviceMessage, error)
+}
+
+// devicePatch - The editable fields of a device, nil fields are left unchanged
+type devicePatch struct {
+	Location    *location `json:"location"`
+	HardwareRef *string   `json:"hardwareRef"`
+	BatteryType *string   `json:"batteryType"`
+	Owner       *string   `json:"owner"`
+	Public      *bool     `json:"public"`
+}
+
+// apply copies the fields set in the patch onto a device
+func (p devicePatch) apply(d *device) {
+	if p.Location != nil {
+		d.Location = p.Location
+	}
+	if p.HardwareRef != nil {
+		d.HardwareRef = *p.HardwareRef
+	}
+	if p.BatteryType != nil {
+		d.BatteryType = *p.BatteryType
+	}
+	if p.Owner != nil {
+		d.Owner = *p.Owner
+	}
+	if p.Public != nil {
+		d.Public = *p.Public
+	}
+}
+
+// ReadingStore - Backend holding the time-series readings. Gateway metadata
+// lives here too as it is derived from the gateway packet statistics.
+type ReadingStore interface {
+	SensorReadings(ctx context.Context, sensorID string, q readingQuery) ([]reading, error)
+	WriteReadings(ctx context.Context, points []readingPoint) error
+	WriteGatewayReceptions(ctx context.Context, receptions []gatewayReception) error
+	Gateways(ctx context.Context) ([]gateway, error)
+}
+
+// readingPoint - A reading to store, with the sensor details it is tagged with
+type readingPoint struct {
+	reading
+	SensorType string // Names the measurement the reading is stored in
+	Unit       string
+	Source     string // Where the reading came from e.g. "api" or "ttn"
+}
+
+// gatewayReception - How a gateway heard an uplink, from the TTN uplink metadata
+type gatewayReception struct {
+	GatewayMac string
+	Device     string // Our ID of the device that sent the uplink
+	Time       time.Time
+	Frequency  float64
+	Channel    uint32
+	RSSI       float64
+	SNR        float64
+	Lat        float64 // Zero when the gateway has not reported its location
+	Lon        float64
+	Altitude   float64
+}
+
+// readingQuery - Filters applied when fetching the readings of a sensor
+type readingQuery struct {
+	Latest    bool      // Only return the most recent reading
+	StartDate time.Time // Lower bound, ignored when zero
+	EndDate   time.Time // Upper bound, ignored when zero
+	Before    time.Time // Page continuation, only readings or buckets at or before this time
+	Limit     int       // Maximum number of readings, defaults to resultLimit
+
+	Aggregate string        // Function applied to each bucket, empty for raw readings
+	Interval  time.Duration // Bucket width when Aggregate is set
+	Fill      string        // How empty buckets are reported, see validFill
+}
+
+// metadataStore returns the configured metadata backend, falling back to CouchDB
+func (c runtimeConfig) metadataStore() MetadataStore {
+	if c.metadata != nil {
+		return c.metadata
+	}
+	return c.Couch
+}
+
+// readingStore returns the configured reading backend, falling back to InfluxDB
+func (c runtimeConfig) readingStore() ReadingStore {
+	if c.readings != nil {
+		return c.readings
+	}
+	return c.Influx
+}
+
+// newestFirst returns a reversed copy of a chronological status history
+func newestFirst(history []status) []status {
+	out := make([]status, len(history))
+	for i := range history {
+		out[len(history)-1-i] = history[i]
+	}
+	return out
+}
+
+// newestMessagesFirst orders announcements by when they were created, newest first
+func newestMessagesFirst(messages []serviceMessage) []serviceMessage {
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Created.After(messages[j].Created) })
+	return messages
+}
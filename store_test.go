@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newMemoryTestConfig returns a config backed by a seeded in-memory store
+func newMemoryTestConfig() (runtimeConfig, *memoryStore) {
+	store := newMemoryStore()
+	store.addDevice(device{ID: "device:testsen1", HardwareRef: "ultrasonic", Owner: "kentnetwork",
+		Location: &location{NearestTown: "Maidstone", CatchmentName: "Medway", Lat: 51.2704, Lon: 0.5227}})
+	store.addSensor(sensor{ID: "device:testsen1:sensorid:1", ParentDevice: "device:testsen1", SensorType: "riverLevel", Unit: "m", UpdateInterval: 15})
+	store.addSensor(sensor{ID: "device:testsen1:sensorid:2", ParentDevice: "device:testsen1", SensorType: "temperature", Unit: "C", UpdateInterval: 15})
+	store.addReadings(
+		reading{Sensor: "device:testsen1:sensorid:1", DateTime: "2018-03-01T10:00:00Z", Value: 1.2},
+		reading{Sensor: "device:testsen1:sensorid:1", DateTime: "2018-03-01T10:15:00Z", Value: 1.3},
+		reading{Sensor: "device:testsen1:sensorid:2", DateTime: "2018-03-01T10:00:00Z", Value: 7.5},
+	)
+
+	config := runtimeConfig{
+		ServerBind: `:80`,
+		Store:      "memory",
+		metadata:   store,
+		readings:   store,
+	}
+	return config, store
+}
+
+func TestMemoryStoreRoutes(t *testing.T) {
+	config, _ := newMemoryTestConfig()
+	router := setupRouter(config)
+
+	Convey("Subject: Routes backed by the in-memory store", t, func() {
+
+		Convey("When /devices is requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then the seeded device is returned", func() {
+				So(w.Code, ShouldEqual, 200)
+				var body struct {
+					Items []device `json:"items"`
+				}
+				So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+				So(len(body.Items), ShouldEqual, 1)
+				So(body.Items[0].ID, ShouldEqual, "device:testsen1")
+			})
+		})
+
+		Convey("When an unknown device is requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices/badrobot", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then the response code should be 404", func() {
+				So(w.Code, ShouldEqual, 404)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Device not found")
+			})
+		})
+
+		Convey("When the sensors of a device are requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices/device:testsen1/sensors", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then both sensors are returned", func() {
+				So(w.Code, ShouldEqual, 200)
+				var body struct {
+					Items []sensor `json:"items"`
+				}
+				So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+				So(len(body.Items), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the latest reading of a sensor is requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/sensors/device:testsen1:sensorid:1/readings?latest=true", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then only the newest reading is returned", func() {
+				So(w.Code, ShouldEqual, 200)
+				var body struct {
+					Items []reading `json:"items"`
+				}
+				So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+				So(len(body.Items), ShouldEqual, 1)
+				So(body.Items[0].Value, ShouldEqual, 1.3)
+			})
+		})
+
+		Convey("When a sensor without readings is requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/sensors/badrobot/readings", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then the response code should be 404", func() {
+				So(w.Code, ShouldEqual, 404)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Sensor not found or sensor has no readings")
+			})
+		})
+
+		Convey("When /data/readings is requested", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/data/readings", nil)
+			router.ServeHTTP(w, req)
+			Convey("Then readings from every sensor are returned", func() {
+				So(w.Code, ShouldEqual, 200)
+				var body struct {
+					Items []reading `json:"items"`
+				}
+				So(json.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+				So(len(body.Items), ShouldEqual, 3)
+			})
+		})
+	})
+}
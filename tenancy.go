@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// groupAdmin sees and manages the resources of every organisation
+	groupAdmin = "admin"
+	// defaultOrgClaim is used unless auth0.orgClaim is configured. Callers
+	// without the claim form an organisation of their own, named by their subject.
+	defaultOrgClaim = "org"
+)
+
+var orgClaim = defaultOrgClaim
+
+// errForbidden is returned when a caller may see a resource but not change it
+var errForbidden = errors.New("forbidden")
+
+// visibility - Whose resources a caller may see. The zero value, used when
+// auth is disabled and for admins, sees everything.
+type visibility struct {
+	Org        string
+	Restricted bool
+}
+
+// ownership - Who a resource belongs to and whether other organisations may see it
+type ownership struct {
+	Owner  string `json:"owner"`
+	Public bool   `json:"public"`
+}
+
+// visibilityFrom returns what the caller of a request may see
+func visibilityFrom(c *gin.Context) visibility {
+	who, ok := callerFrom(c)
+	if !ok || who.inGroup(groupAdmin) {
+		return visibility{}
+	}
+	return visibility{Org: who.Org, Restricted: true}
+}
+
+// canSee reports whether a resource with the owner is visible to the caller
+func (v visibility) canSee(owner string, public bool) bool {
+	return !v.Restricted || public || owner == v.Org
+}
+
+// canManage reports whether the caller may change a resource with the owner
+func (v visibility) canManage(owner string) bool {
+	return !v.Restricted || owner == v.Org
+}
+
+// visibleDevice returns a device if the caller may see it. Hidden devices are
+// reported as not found so their existence is not given away.
+func visibleDevice(ctx context.Context, store MetadataStore, v visibility, deviceID string) (device, error) {
+	d, err := store.Device(ctx, deviceID)
+	if err != nil {
+		return d, err
+	}
+	if !v.canSee(d.Owner, d.Public) {
+		return device{}, errNotFound
+	}
+	return d, nil
+}
+
+// manageableDevice returns a device if the caller may change it
+func manageableDevice(ctx context.Context, store MetadataStore, v visibility, deviceID string) (device, error) {
+	d, err := visibleDevice(ctx, store, v, deviceID)
+	if err != nil {
+		return d, err
+	}
+	if !v.canManage(d.Owner) {
+		return d, errForbidden
+	}
+	return d, nil
+}
+
+// visibleSensor returns a sensor if the caller may see its parent device
+func visibleSensor(ctx context.Context, store MetadataStore, v visibility, sensorID string) (sensor, error) {
+	s, err := store.Sensor(ctx, sensorID)
+	if err != nil || !v.Restricted {
+		return s, err
+	}
+	if _, err = visibleDevice(ctx, store, v, s.ParentDevice); err != nil {
+		return sensor{}, err
+	}
+	return s, nil
+}
+
+// manageableSensor returns a sensor if the caller may change its parent device
+func manageableSensor(ctx context.Context, store MetadataStore, v visibility, sensorID string) (sensor, error) {
+	s, err := store.Sensor(ctx, sensorID)
+	if err != nil || !v.Restricted {
+		return s, err
+	}
+	if _, err = manageableDevice(ctx, store, v, s.ParentDevice); err != nil {
+		return sensor{}, err
+	}
+	return s, nil
+}
+
+// visibleSensors returns a filter for the sensors of the devices the caller may see
+func visibleSensors(ctx context.Context, store MetadataStore, v visibility) (sensorFilter, error) {
+	if !v.Restricted {
+		return sensorFilter{}, nil
+	}
+	ids, err := store.VisibleDeviceIDs(ctx, v.Org)
+	if err != nil {
+		return sensorFilter{}, err
+	}
+	f := sensorFilter{ParentDevices: map[string]bool{}}
+	for _, id := range ids {
+		f.ParentDevices[id] = true
+	}
+	return f, nil
+}
+
+// visibleGateways drops the gateways the caller may not see. Gateways without
+// a registered owner are shared network infrastructure and visible to all.
+func visibleGateways(ctx context.Context, store MetadataStore, v visibility, gateways []gateway) ([]gateway, error) {
+	if !v.Restricted {
+		return gateways, nil
+	}
+	owners, err := store.GatewayOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	visible := []gateway{}
+	for _, g := range gateways {
+		if o, ok := owners[g.GatewayMac]; !ok || v.canSee(o.Owner, o.Public) {
+			visible = append(visible, g)
+		}
+	}
+	return visible, nil
+}
+
+// visibleDeviceSensors returns the sensors of a device, none if the caller may not see it
+func visibleDeviceSensors(ctx context.Context, store MetadataStore, v visibility, deviceID string) ([]sensor, error) {
+	if v.Restricted {
+		_, err := visibleDevice(ctx, store, v, deviceID)
+		if err == errNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.DeviceSensors(ctx, deviceID)
+}
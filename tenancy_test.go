@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTenancy(t *testing.T) {
+	signer := testSigner(t)
+	defer func() { validator, groupsClaim = nil, defaultGroupsClaim }()
+
+	token := func(org string, groups ...string) string {
+		return testToken(signer, "auth0|"+org, map[string]interface{}{"groups": groups, "org": org})
+	}
+	kent := token("kentnetwork", groupDeviceAdmin)
+	medway := token("medway", groupDeviceAdmin)
+	admin := token("operators", groupAdmin)
+
+	Convey("Subject: Resources are scoped to the caller's organisation", t, func() {
+		config, store := newMemoryTestConfig()
+		config.Auth0.Key = "test"
+		store.addDevice(device{ID: "device:medway1", Owner: "medway"})
+		store.addSensor(sensor{ID: "device:medway1:sensorid:1", ParentDevice: "device:medway1", SensorType: "riverLevel", Unit: "m", UpdateInterval: 15})
+		store.addReadings(reading{Sensor: "device:medway1:sensorid:1", DateTime: "2018-03-01T10:00:00Z", Value: 2.1})
+		store.addDevice(device{ID: "device:shared", Owner: "medway", Public: true})
+		store.gateways = []gateway{{GatewayMac: "b827ebfffe000001"}, {GatewayMac: "b827ebfffe000002"}}
+		store.owners["b827ebfffe000002"] = ownership{Owner: "medway"}
+		router := setupRouter(config)
+
+		request := func(method, path, token, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			return w
+		}
+		ids := func(w *httptest.ResponseRecorder, key string) (found []string) {
+			var body struct {
+				Items []map[string]interface{} `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			for _, item := range body.Items {
+				found = append(found, item[key].(string))
+			}
+			return found
+		}
+
+		Convey("When each organisation lists devices", func() {
+			Convey("Then it sees its own and public devices only", func() {
+				So(ids(request("GET", "/devices", kent, ""), "@id"), ShouldResemble, []string{"device:shared", "device:testsen1"})
+				So(ids(request("GET", "/devices", medway, ""), "@id"), ShouldResemble, []string{"device:medway1", "device:shared"})
+			})
+			Convey("Then an admin sees every device", func() {
+				So(len(ids(request("GET", "/devices", admin, ""), "@id")), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When another organisation's device is requested", func() {
+			So(request("GET", "/devices/device:medway1", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/devices/device:medway1/sensors", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/devices/device:medway1/readings", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/devices/device:medway1/status", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/sensors/device:medway1:sensorid:1", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/sensors/device:medway1:sensorid:1/readings", kent, "").Code, ShouldEqual, 404)
+			So(request("GET", "/devices/device:medway1", admin, "").Code, ShouldEqual, 200)
+		})
+
+		Convey("When sensors and readings are listed", func() {
+			So(ids(request("GET", "/sensors", kent, ""), "@id"), ShouldNotContain, "device:medway1:sensorid:1")
+			So(ids(request("GET", "/data/readings", kent, ""), "sensor"), ShouldNotContain, "device:medway1:sensorid:1")
+			So(ids(request("GET", "/data/readings", medway, ""), "sensor"), ShouldContain, "device:medway1:sensorid:1")
+		})
+
+		Convey("When gateways are listed", func() {
+			Convey("Then unregistered gateways are visible to everyone", func() {
+				So(ids(request("GET", "/gateways", kent, ""), "gatewayMac"), ShouldResemble, []string{"b827ebfffe000001"})
+				So(len(ids(request("GET", "/gateways", medway, ""), "gatewayMac")), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When a public device of another organisation is changed", func() {
+			So(request("PATCH", "/devices/device:shared", kent, `{"batteryType":"AA"}`).Code, ShouldEqual, 403)
+			So(request("DELETE", "/devices/device:shared", kent, "").Code, ShouldEqual, 403)
+			So(request("POST", "/devices/device:shared/status", kent, `{"type":"Active"}`).Code, ShouldEqual, 403)
+			So(request("POST", "/sensors", kent, `{"parentDevice":"device:shared","sensorType":"rainfall","unit":"mm","updateInterval":30}`).Code, ShouldEqual, 403)
+			So(request("DELETE", "/sensors/device:medway1:sensorid:1", kent, "").Code, ShouldEqual, 404)
+			So(request("POST", "/sensors/device:medway1:sensorid:1/readings", kent, `[{"value":2.2,"unit":"m"}]`).Code, ShouldEqual, 404)
+		})
+
+		Convey("When a device is moved to another organisation", func() {
+			So(request("PATCH", "/devices/device:testsen1", kent, `{"owner":"medway"}`).Code, ShouldEqual, 403)
+			So(request("PATCH", "/devices/device:testsen1", admin, `{"owner":"medway"}`).Code, ShouldEqual, 200)
+			So(request("GET", "/devices/device:testsen1", kent, "").Code, ShouldEqual, 404)
+		})
+
+		Convey("When a device is created", func() {
+			config.devices = newFakeTTN()
+			router = setupRouter(config)
+			w := request("POST", "/devices", medway, `{"hardwareRef":"ultrasonic"}`)
+			Convey("Then it belongs to the caller's organisation", func() {
+				var body struct {
+					Items device `json:"items"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				So(body.Items.Owner, ShouldEqual, "medway")
+				So(request("POST", "/devices", medway, `{"hardwareRef":"ultrasonic","owner":"kentnetwork"}`).Code, ShouldEqual, 403)
+			})
+		})
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackendTimeouts(t *testing.T) {
+
+	// A backend that answers only after a delay, or when the caller gives up
+	slow := func(delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+				w.Write([]byte(`{}`))
+			case <-r.Context().Done():
+			}
+		}))
+	}
+
+	Convey("Subject: Bounding CouchDB and InfluxDB calls", t, func() {
+
+		Convey("When CouchDB is slower than its timeout", func() {
+			couch := slow(time.Second)
+			defer couch.Close()
+			router := setupRouter(runtimeConfig{Couch: couchConfig{Host: couch.URL, Timeout: "50ms"}})
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/devices/device:testsen1", nil)
+			router.ServeHTTP(w, req)
+
+			Convey("Then the request gives up with a 504", func() {
+				So(w.Code, ShouldEqual, 504)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Couchdb connection error")
+				So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			})
+		})
+
+		Convey("When InfluxDB is slower than its timeout", func() {
+			influx := slow(time.Second)
+			defer influx.Close()
+			config, _ := runtimeConfig{Influx: influxConfig{Host: influx.URL, Timeout: "50ms"}}.influxDBClient()
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/gateways", nil)
+			setupRouter(config).ServeHTTP(w, req)
+
+			Convey("Then the request gives up with a 504", func() {
+				So(w.Code, ShouldEqual, 504)
+				So(errorMessage(w.Body.Bytes()), ShouldEqual, "Influxdb connection error")
+			})
+		})
+
+		Convey("When the caller goes away", func() {
+			couch := slow(time.Second)
+			defer couch.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := couchConfig{Host: couch.URL}.Device(ctx, "device:testsen1")
+			config, _ := runtimeConfig{Influx: influxConfig{Host: couch.URL}}.influxDBClient()
+			_, influxErr := config.Influx.SensorReadings(ctx, "device:testsen1:sensorid:1", readingQuery{})
+			_, loginErr := passwordGrant(ctx, auth0Config{TokenURL: couch.URL, ClientID: "api"}, "user", "pass")
+
+			Convey("Then the backend calls made for it are abandoned", func() {
+				So(errors.Is(err, context.Canceled), ShouldBeTrue)
+				So(influxErr, ShouldNotBeNil)
+				So(errors.Is(loginErr, context.Canceled), ShouldBeTrue)
+			})
+		})
+
+		Convey("When no timeout is configured", func() {
+			So(couchConfig{}.timeout(), ShouldEqual, defaultBackendTimeout)
+			So(influxConfig{Timeout: "2s"}.timeout(), ShouldEqual, 2*time.Second)
+			config := runtimeConfig{ServerBind: ":8080", TTN: ttnConfig{AppID: "app", AppAccessKey: "key"}, Couch: couchConfig{Timeout: "soon"}}
+			So(validConfig(config).Error(), ShouldContainSubstring, "couch timeout")
+		})
+	})
+}
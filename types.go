@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
 	ttnsdk "github.com/TheThingsNetwork/go-app-sdk"
 )
 
@@ -32,6 +37,62 @@ const (
 	Maintenance   eventType = iota + 1
 )
 
+// String returns the name of the event type as listed in events
+func (e eventType) String() string {
+	if e < Unseen || int(e) > len(events) {
+		return "Unknown"
+	}
+	return events[e-1]
+}
+
+// parseEventType accepts an event type by name (case-insensitive) or number
+func parseEventType(s string) (eventType, error) {
+	for i, name := range events {
+		if strings.EqualFold(s, name) || s == strconv.Itoa(i+1) {
+			return eventType(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", s)
+}
+
+// UnmarshalJSON accepts the numeric form used in stored documents as well as the event name
+func (e *eventType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		t, err := parseEventType(name)
+		*e = t
+		return err
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*e = eventType(n)
+	return nil
+}
+
+// transitionError - A status event that is not allowed from the device's current status
+type transitionError struct {
+	From eventType
+	To   eventType
+}
+
+func (e transitionError) Error() string {
+	return fmt.Sprintf("a device cannot move from %s to %s", e.From, e.To)
+}
+
+// validTransition checks a device may move between two statuses. Unseen is only
+// ever the initial status and Decommisioned is terminal.
+func validTransition(from eventType, to eventType) error {
+	if to < Unseen || int(to) > len(events) {
+		return fmt.Errorf("unknown status %d", to)
+	}
+	if from == Decommisioned || (to == Unseen && from != Unseen) {
+		return transitionError{From: from, To: to}
+	}
+	return nil
+}
+
 // Status - A device contains an array of different status events
 type status struct {
 	Type     eventType `json:"type"`
@@ -74,6 +135,8 @@ type device struct {
 	HardwareRef string    `json:"hardwareRef"`
 	BatteryType string    `json:"batteryType"`
 	Owner       string    `json:"owner"`
+	Public      bool      `json:"public,omitempty"` // Visible to every organisation, not only the owner
+	Status      *status   `json:"status,omitempty"` // Current status, absent until the first status event
 }
 
 // Gateway represents metadata about a gateway
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const sourceTTN = "ttn" // Tags readings decoded from TTN uplinks
+
+// ttnUplink - An uplink as sent by the TTN HTTP integration, and by its MQTT broker
+type ttnUplink struct {
+	AppID          string                 `json:"app_id"`
+	DevID          string                 `json:"dev_id"`
+	HardwareSerial string                 `json:"hardware_serial"`
+	Port           uint8                  `json:"port"`
+	Counter        uint32                 `json:"counter"`
+	PayloadRaw     []byte                 `json:"payload_raw"` // base64 in JSON
+	PayloadFields  map[string]interface{} `json:"payload_fields"`
+	Metadata       ttnUplinkMetadata      `json:"metadata"`
+}
+
+type ttnUplinkMetadata struct {
+	Time      string               `json:"time"` // When the network server received the uplink
+	Frequency float64              `json:"frequency"`
+	DataRate  string               `json:"data_rate"`
+	Gateways  []ttnGatewayMetadata `json:"gateways"`
+}
+
+type ttnGatewayMetadata struct {
+	GtwID     string  `json:"gtw_id"` // "eui-" followed by the gateway MAC for packet forwarder gateways
+	Time      string  `json:"time"`
+	Channel   uint32  `json:"channel"`
+	RSSI      float64 `json:"rssi"`
+	SNR       float64 `json:"snr"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// uplinkError - An uplink that cannot be turned into readings
+type uplinkError struct {
+	msg string
+}
+
+func (e uplinkError) Error() string {
+	return e.msg
+}
+
+var errDecommissioned = errors.New("device is decommissioned")
+
+// receivedAt returns when the network server received the uplink, or fallback
+// when the metadata does not say
+func (u ttnUplink) receivedAt(fallback time.Time) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, u.Metadata.Time); err == nil && !t.IsZero() && t.Year() > 1970 {
+		return t
+	}
+	return fallback
+}
+
+// gatewayMac returns the MAC of a packet forwarder gateway from its TTN gateway ID
+func gatewayMac(gtwID string) string {
+	return strings.ToLower(strings.TrimPrefix(gtwID, "eui-"))
+}
+
+// uplinkDevice finds our device for a TTN dev_id by its TTN metadata. Devices
+// stored without TTN metadata are registered under their own ID.
+func uplinkDevice(ctx context.Context, store MetadataStore, devID string) (device, error) {
+	d, err := store.DeviceByTTNDevID(ctx, devID)
+	if err != errNotFound {
+		return d, err
+	}
+	return store.Device(ctx, devID)
+}
+
+// uplinkReadings decodes an uplink with the decoder for the device's hardware
+// and matches each value to the device's sensor of that type. Values without a
+// matching sensor, or in a unit the sensor cannot take, are returned as skipped.
+func uplinkReadings(d device, sensors []sensor, up ttnUplink, at time.Time) (points []readingPoint, skipped []decodedValue, err error) {
+	values, err := decodeUplink(d.HardwareRef, up.PayloadRaw, up.PayloadFields)
+	if err != nil {
+		return nil, nil, uplinkError{fmt.Sprintf("cannot decode %s payload: %s", d.HardwareRef, err)}
+	}
+
+	dateTime := at.UTC().Format(dateTimeLayout)
+	for _, v := range values {
+		matched := false
+		for _, s := range sensors {
+			if s.SensorType != v.SensorType {
+				continue
+			}
+			value, ok := v.inUnit(s.Unit)
+			if !ok {
+				continue
+			}
+			matched = true
+			points = append(points, readingPoint{
+				reading:    reading{Sensor: s.ID, DateTime: dateTime, Value: value},
+				SensorType: s.SensorType,
+				Unit:       s.Unit,
+				Source:     sourceTTN,
+			})
+		}
+		if !matched {
+			skipped = append(skipped, v)
+		}
+	}
+	return points, skipped, nil
+}
+
+// uplinkReceptions lists the gateways that heard an uplink
+func uplinkReceptions(d device, up ttnUplink, at time.Time) []gatewayReception {
+	receptions := make([]gatewayReception, 0, len(up.Metadata.Gateways))
+	for _, g := range up.Metadata.Gateways {
+		heard, err := time.Parse(time.RFC3339Nano, g.Time)
+		if err != nil || heard.Year() <= 1970 {
+			heard = at
+		}
+		receptions = append(receptions, gatewayReception{
+			GatewayMac: gatewayMac(g.GtwID),
+			Device:     d.ID,
+			Time:       heard,
+			Frequency:  up.Metadata.Frequency,
+			Channel:    g.Channel,
+			RSSI:       g.RSSI,
+			SNR:        g.SNR,
+			Lat:        g.Latitude,
+			Lon:        g.Longitude,
+			Altitude:   g.Altitude,
+		})
+	}
+	return receptions
+}
+
+// handleUplink stores the readings decoded from an uplink and the metadata of
+// the gateways that heard it, returning the readings stored
+func handleUplink(ctx context.Context, config runtimeConfig, up ttnUplink, received time.Time) ([]reading, error) {
+	if up.DevID == "" {
+		return nil, uplinkError{"uplink has no dev_id"}
+	}
+	if config.TTN.AppID != "" && up.AppID != config.TTN.AppID {
+		return nil, uplinkError{fmt.Sprintf("uplink is for application %q, not %q", up.AppID, config.TTN.AppID)}
+	}
+
+	store := config.metadataStore()
+	d, err := uplinkDevice(ctx, store, up.DevID)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != nil && d.Status.Type == Decommisioned {
+		return nil, errDecommissioned
+	}
+	sensors, err := store.DeviceSensors(ctx, d.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	at := up.receivedAt(received)
+	points, skipped, err := uplinkReadings(d, sensors, up, at)
+	if err != nil {
+		return nil, err
+	}
+	l := contextLog(ctx).With(logFields{"devId": up.DevID, "deviceId": d.ID})
+	for _, v := range skipped {
+		l.With(logFields{"sensorType": v.SensorType, "unit": v.Unit}).Warn("decoded value has no matching sensor")
+	}
+
+	readings := config.readingStore()
+	if len(points) > 0 {
+		if err = readings.WriteReadings(ctx, points); err != nil {
+			return nil, err
+		}
+	}
+	if receptions := uplinkReceptions(d, up, at); len(receptions) > 0 {
+		// The readings are stored, so losing the gateway metadata is only logged
+		if err = readings.WriteGatewayReceptions(ctx, receptions); err != nil {
+			l.WithError(err).Error("could not store gateway metadata")
+		}
+	}
+
+	stored := make([]reading, len(points))
+	for i := range points {
+		stored[i] = points[i].reading
+	}
+	return stored, nil
+}
+
+// subscribeUplinks receives uplinks from the TTN MQTT broker through the SDK,
+// as an alternative to the HTTP integration, until the subscription ends
+func subscribeUplinks(config runtimeConfig) error {
+	client := config.TTN.connect()
+	pubsub, err := client.PubSub()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	uplinks, err := pubsub.AllDevices().SubscribeUplink()
+	if err != nil {
+		pubsub.Close()
+		client.Close()
+		return err
+	}
+
+	go func() {
+		defer client.Close()
+		defer pubsub.Close()
+		for msg := range uplinks {
+			// The SDK message has the same JSON form as the HTTP integration's
+			var up ttnUplink
+			data, err := json.Marshal(msg)
+			if err == nil {
+				err = json.Unmarshal(data, &up)
+			}
+			ctx := withRequestID(context.Background(), newRequestID())
+			if err == nil {
+				_, err = handleUplink(ctx, config, up, time.Now())
+			}
+			observeUplink("mqtt", err)
+			if err != nil {
+				contextLog(ctx).WithError(err).With(logFields{"devId": up.DevID}).Warn("uplink not stored")
+			}
+		}
+		logs.Warn("TTN uplink subscription ended")
+	}()
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testUplink builds an uplink as the TTN HTTP integration sends it, heard by one gateway
+func testUplink(devID string, payload []byte, fields map[string]interface{}) ttnUplink {
+	return ttnUplink{
+		AppID:         "kent-app",
+		DevID:         devID,
+		PayloadRaw:    payload,
+		PayloadFields: fields,
+		Metadata: ttnUplinkMetadata{
+			Time:      "2018-03-04T12:00:00.5Z",
+			Frequency: 868.1,
+			Gateways: []ttnGatewayMetadata{
+				{GtwID: "eui-B827EBFFFE000001", Time: "2018-03-04T12:00:00.4Z", RSSI: -97, SNR: 7.5, Latitude: 51.27, Longitude: 0.52},
+			},
+		},
+	}
+}
+
+func TestTTNUplink(t *testing.T) {
+
+	Convey("Subject: Receiving uplinks from TTN", t, func() {
+		config, store := newMemoryTestConfig()
+		config.TTN = ttnConfig{AppID: "kent-app", WebhookKey: "webhook-secret"}
+		store.addDevice(device{ID: "device:legacy", HardwareRef: "weather", Ttn: &ttn{DevID: "legacy-node"}})
+		store.addSensor(sensor{ID: "device:legacy:sensorid:1", ParentDevice: "device:legacy", SensorType: "temperature", Unit: "C"})
+		router := setupRouter(config)
+
+		send := func(key string, up interface{}) (*httptest.ResponseRecorder, []reading) {
+			body, _ := json.Marshal(up)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/ttn/uplink", strings.NewReader(string(body)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", key)
+			router.ServeHTTP(w, req)
+			var resp struct {
+				Items []reading `json:"items"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w, resp.Items
+		}
+
+		Convey("When an ultrasonic device sends its payload", func() {
+			stored := testutil.ToFloat64(ttnUplinks.WithLabelValues("http", "stored"))
+			w, readings := send("webhook-secret", testUplink("device:testsen1", []byte{0x04, 0xB0, 0x0E, 0x10}, nil))
+
+			Convey("Then the river level is stored in the sensor's unit at the uplink time", func() {
+				So(w.Code, ShouldEqual, 200)
+				So(readings, ShouldResemble, []reading{{Sensor: "device:testsen1:sensorid:1", DateTime: "2018-03-04T12:00:00.5Z", Value: 1.2}})
+				latest, _ := store.SensorReadings(context.Background(), "device:testsen1:sensorid:1", readingQuery{Latest: true, Limit: 1})
+				So(latest[0].Value, ShouldEqual, 1.2)
+				So(testutil.ToFloat64(ttnUplinks.WithLabelValues("http", "stored")), ShouldEqual, stored+1)
+			})
+
+			Convey("Then the gateway that heard it is recorded", func() {
+				So(store.receptions, ShouldHaveLength, 1)
+				So(store.receptions[0].GatewayMac, ShouldEqual, "b827ebfffe000001")
+				So(store.receptions[0].Device, ShouldEqual, "device:testsen1")
+				So(store.receptions[0].RSSI, ShouldEqual, -97)
+			})
+		})
+
+		Convey("When a device registered before dev_ids matched our IDs sends payload fields", func() {
+			w, readings := send("webhook-secret", testUplink("legacy-node", nil, map[string]interface{}{"temperature": 11.5, "counter": 3}))
+			So(w.Code, ShouldEqual, 200)
+			So(readings, ShouldHaveLength, 1)
+			So(readings[0].Sensor, ShouldEqual, "device:legacy:sensorid:1")
+			So(readings[0].Value, ShouldEqual, 11.5)
+		})
+
+		Convey("When an uplink is refused", func() {
+			webhookFailures := testutil.ToFloat64(authFailures.WithLabelValues(authInvalidWebhookKey))
+			apiKeyFailures := testutil.ToFloat64(authFailures.WithLabelValues(authInvalidAPIKey))
+			w, _ := send("wrong", testUplink("device:testsen1", []byte{0, 1, 0, 1}, nil))
+			So(w.Code, ShouldEqual, 401)
+			So(testutil.ToFloat64(authFailures.WithLabelValues(authInvalidWebhookKey)), ShouldEqual, webhookFailures+1)
+			So(testutil.ToFloat64(authFailures.WithLabelValues(authInvalidAPIKey)), ShouldEqual, apiKeyFailures)
+			w, _ = send("webhook-secret", testUplink("unknown-node", []byte{0, 1, 0, 1}, nil))
+			So(w.Code, ShouldEqual, 404)
+			w, _ = send("webhook-secret", testUplink("device:testsen1", []byte{0x01}, nil))
+			So(w.Code, ShouldEqual, 400)
+			other := testUplink("device:testsen1", []byte{0, 1, 0, 1}, nil)
+			other.AppID = "someone-else"
+			w, _ = send("webhook-secret", other)
+			So(w.Code, ShouldEqual, 400)
+			So(store.readings["device:testsen1:sensorid:1"], ShouldHaveLength, 2)
+		})
+
+		Convey("When the device has been decommissioned", func() {
+			store.AddStatusEvent(context.Background(), "device:legacy", status{Type: Decommisioned, DateTime: "2018-03-04T00:00:00Z"})
+			w, _ := send("webhook-secret", testUplink("legacy-node", nil, map[string]interface{}{"temperature": 11.5}))
+			So(w.Code, ShouldEqual, 409)
+		})
+
+		Convey("When no webhook key is configured", func() {
+			config.TTN.WebhookKey = ""
+			router = setupRouter(config)
+			w, _ := send("", testUplink("device:testsen1", []byte{0, 1, 0, 1}, nil))
+			So(w.Code, ShouldEqual, 501)
+		})
+
+		Convey("When uplinks are written to InfluxDB", func() {
+			var mu sync.Mutex
+			writes := map[string]string{}
+			influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				writes[r.URL.Query().Get("db")] = string(body)
+				mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer influx.Close()
+			config.readings = nil
+			config.Influx = influxConfig{Host: influx.URL, Db: "kentnetwork"}
+			config, _ = config.influxDBClient()
+			router = setupRouter(config)
+
+			w, _ := send("webhook-secret", testUplink("device:testsen1", []byte{0x04, 0xB0, 0x0E, 0x10}, nil))
+
+			Convey("Then readings are tagged with the sensor and gateway metadata goes to the gateway database", func() {
+				So(w.Code, ShouldEqual, 200)
+				So(writes["kentnetwork"], ShouldContainSubstring, "sensor_id=device:testsen1:sensorid:1")
+				So(writes["kentnetwork"], ShouldContainSubstring, "source=ttn")
+				So(writes[gatewayDb], ShouldStartWith, "rxpk,")
+				So(writes[gatewayDb], ShouldContainSubstring, "gatewayMac=b827ebfffe000001")
+			})
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+	_ "time/tzdata" // The alpine runtime image ships without a zone database
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	dateTimeLayout = "2006-01-02T15:04:05.999Z07:00"
+	dateLayout     = "2006-01-02"
+)
+
+// london - Day boundaries for today and date follow UK local time, including BST
+var london = mustLoadLocation("Europe/London")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// parseReadingWindow reads the latest, today, date, since, startDate and endDate
+// query parameters shared by every readings endpoint
+func parseReadingWindow(c *gin.Context) (readingQuery, error) {
+	return readingWindow(c.Request.URL.Query(), time.Now())
+}
+
+// readingWindow turns the time filters of a readings request into a query. Only
+// one of latest, today, date, since and startDate may be given.
+func readingWindow(params url.Values, now time.Time) (q readingQuery, err error) {
+	startDate := params.Get("startDate")
+	if startDate == "" {
+		// kentAPI.yaml has documented both spellings
+		startDate = params.Get("startdate")
+	}
+	endDate := params.Get("endDate")
+
+	given := 0
+	for _, v := range []string{params.Get("latest"), params.Get("today"), params.Get("date"), params.Get("since"), startDate} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return q, errors.New("only one of latest, today, date, since and startDate may be used")
+	}
+	if endDate != "" && startDate == "" {
+		return q, errors.New("endDate must be used together with startDate")
+	}
+
+	switch {
+	case params.Get("latest") != "":
+		q.Latest, err = strconv.ParseBool(params.Get("latest"))
+
+	case params.Get("today") != "":
+		var today bool
+		if today, err = strconv.ParseBool(params.Get("today")); err == nil && today {
+			q.StartDate = startOfDay(now.In(london))
+			q.EndDate = now
+		}
+
+	case params.Get("date") != "":
+		var day time.Time
+		if day, err = time.ParseInLocation(dateLayout, params.Get("date"), london); err == nil {
+			q.StartDate = day
+			q.EndDate = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+
+	case params.Get("since") != "":
+		if q.StartDate, err = parseDateTime(params.Get("since")); err == nil {
+			q.EndDate = now
+		}
+
+	case startDate != "":
+		if q.StartDate, err = parseDateTime(startDate); err != nil {
+			return q, err
+		}
+		q.EndDate = now
+		if endDate != "" {
+			if q.EndDate, err = parseDateTime(endDate); err != nil {
+				return q, err
+			}
+		}
+		if q.EndDate.Before(q.StartDate) {
+			return q, errors.New("endDate is before startDate")
+		}
+	}
+	return q, err
+}
+
+// parseDateTime accepts an RFC3339 timestamp or a plain date, taken as UK midnight
+func parseDateTime(s string) (time.Time, error) {
+	if t, err := time.Parse(dateTimeLayout, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(dateLayout, s, london)
+}
+
+// startOfDay returns local midnight of t's day in t's location
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
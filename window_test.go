@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadingWindow(t *testing.T) {
+	// 00:30 BST on 1st July is still 30th June in UTC
+	now := time.Date(2018, 6, 30, 23, 30, 0, 0, time.UTC)
+
+	window := func(query string) (readingQuery, error) {
+		params, _ := url.ParseQuery(query)
+		return readingWindow(params, now)
+	}
+
+	Convey("Subject: Parsing the reading time filters", t, func() {
+
+		Convey("When today is requested during British Summer Time", func() {
+			q, err := window("today=true")
+			Convey("Then the window starts at UK midnight, not UTC midnight", func() {
+				So(err, ShouldBeNil)
+				So(q.StartDate.UTC(), ShouldEqual, time.Date(2018, 6, 30, 23, 0, 0, 0, time.UTC))
+				So(q.EndDate, ShouldEqual, now)
+			})
+		})
+
+		Convey("When a winter date is requested", func() {
+			q, err := window("date=2018-01-15")
+			Convey("Then the window covers the whole GMT day", func() {
+				So(err, ShouldBeNil)
+				So(q.StartDate.UTC(), ShouldEqual, time.Date(2018, 1, 15, 0, 0, 0, 0, time.UTC))
+				So(q.EndDate.UTC(), ShouldEqual, time.Date(2018, 1, 15, 23, 59, 59, 999999999, time.UTC))
+			})
+		})
+
+		Convey("When the clocks go forward", func() {
+			q, err := window("date=2018-03-25")
+			Convey("Then the day is 23 hours long", func() {
+				So(err, ShouldBeNil)
+				So(q.EndDate.Sub(q.StartDate), ShouldEqual, 23*time.Hour-time.Nanosecond)
+			})
+		})
+
+		Convey("When since is given a timestamp", func() {
+			q, err := window("since=2018-06-01T12:00:00Z")
+			So(err, ShouldBeNil)
+			So(q.StartDate, ShouldEqual, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+			So(q.EndDate, ShouldEqual, now)
+		})
+
+		Convey("When the lowercase startdate spelling from the spec is used", func() {
+			q, err := window("startdate=2018-06-01T00:00:00Z&endDate=2018-06-02T00:00:00Z")
+			So(err, ShouldBeNil)
+			So(q.EndDate.Sub(q.StartDate), ShouldEqual, 24*time.Hour)
+		})
+
+		Convey("When filters are combined or malformed", func() {
+			for _, query := range []string{
+				"latest=true&today=true",
+				"date=2018-01-15&since=2018-01-01",
+				"endDate=2018-01-01T00:00:00Z",
+				"startDate=2018-02-01T00:00:00Z&endDate=2018-01-01T00:00:00Z",
+				"date=15/01/2018",
+				"today=yes",
+			} {
+				_, err := window(query)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}